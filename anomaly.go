@@ -0,0 +1,306 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+// Anomaly kinds.
+const (
+	// AnomalyPlateau is coverage that stopped growing.
+	AnomalyPlateau = "coverage_plateau"
+	// AnomalyExecDrop is an exec rate that collapsed.
+	AnomalyExecDrop = "exec_rate_drop"
+	// AnomalyCrashSpike is a crash rate that jumped.
+	AnomalyCrashSpike = "crash_rate_spike"
+)
+
+// anomalyKinds are all anomaly kinds.
+var anomalyKinds = []string{AnomalyPlateau, AnomalyExecDrop, AnomalyCrashSpike}
+
+// AnomalyConfig configures the detection of anomalies in manager stats.
+type AnomalyConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// PlateauWindow is how long coverage may stay flat, it defaults to 6
+	// hours.
+	PlateauWindow time.Duration `yaml:"plateau_window"`
+	// RecentWindow is the window recent rates are measured over, it
+	// defaults to 30 minutes.
+	RecentWindow time.Duration `yaml:"recent_window"`
+	// BaselineWindow is the window before the recent one that recent
+	// rates are compared to, it defaults to 6 hours.
+	BaselineWindow time.Duration `yaml:"baseline_window"`
+	// ExecDrop is the fraction of the baseline exec rate below which the
+	// recent one is a drop, it defaults to 0.5.
+	ExecDrop float64 `yaml:"exec_drop"`
+	// CrashSpike is the multiple of the baseline crash rate above which
+	// the recent one is a spike, it defaults to 3.
+	CrashSpike float64 `yaml:"crash_spike"`
+	// MinCrashes is the number of recent crashes a spike needs at least,
+	// it defaults to 5.
+	MinCrashes uint64 `yaml:"min_crashes"`
+}
+
+func (conf *AnomalyConfig) validate() error {
+	if conf.PlateauWindow == 0 {
+		conf.PlateauWindow = 6 * time.Hour
+	}
+	if conf.RecentWindow == 0 {
+		conf.RecentWindow = 30 * time.Minute
+	}
+	if conf.BaselineWindow == 0 {
+		conf.BaselineWindow = 6 * time.Hour
+	}
+	if conf.ExecDrop == 0 {
+		conf.ExecDrop = 0.5
+	}
+	if conf.CrashSpike == 0 {
+		conf.CrashSpike = 3
+	}
+	if conf.MinCrashes == 0 {
+		conf.MinCrashes = 5
+	}
+	if conf.PlateauWindow < 0 || conf.RecentWindow < 0 || conf.BaselineWindow < 0 {
+		return fmt.Errorf("anomalies: negative window")
+	}
+	if conf.ExecDrop < 0 || conf.ExecDrop > 1 || conf.CrashSpike < 1 {
+		return fmt.Errorf("anomalies: exec_drop must be in [0, 1] and crash_spike at least 1")
+	}
+	return nil
+}
+
+// history returns how long samples are kept.
+func (conf *AnomalyConfig) history() time.Duration {
+	if h := conf.RecentWindow + conf.BaselineWindow; h > conf.PlateauWindow {
+		return h
+	}
+	return conf.PlateauWindow
+}
+
+// statsSample is a manager stats upload.
+type statsSample struct {
+	time    time.Time
+	upTime  time.Duration
+	cover   uint64
+	execs   uint64
+	crashes uint64
+}
+
+// anomaly is an anomaly found in the stats of a manager.
+type anomaly struct {
+	Manager string    `json:"manager"`
+	Kind    string    `json:"kind"`
+	Since   time.Time `json:"since"`
+	Detail  string    `json:"detail"`
+}
+
+// anomalyDetector analyses the stats uploads of managers.
+type anomalyDetector struct {
+	conf    AnomalyConfig
+	log     *slog.Logger
+	metrics *metrics
+
+	mu       sync.Mutex
+	samples  map[string][]statsSample
+	findings map[[2]string]*anomaly
+}
+
+func newAnomalyDetector(conf AnomalyConfig, log *slog.Logger, m *metrics) *anomalyDetector {
+	return &anomalyDetector{
+		conf:     conf,
+		log:      log,
+		metrics:  m,
+		samples:  map[string][]statsSample{},
+		findings: map[[2]string]*anomaly{},
+	}
+}
+
+// add analyses a stats upload of a manager.
+func (d *anomalyDetector) add(req *dashapi.ManagerStatsReq) {
+	if !d.conf.Enabled {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	samples := d.samples[req.Name]
+	// The stats of a restarted manager start over.
+	if n := len(samples); n > 0 && req.UpTime < samples[n-1].upTime {
+		samples = nil
+	}
+	cutoff := now.Add(-d.conf.history())
+	for len(samples) > 1 && samples[1].time.Before(cutoff) {
+		samples = samples[1:]
+	}
+	samples = append(samples, statsSample{now, req.UpTime, req.Cover, req.Execs, req.Crashes})
+	d.samples[req.Name] = samples
+
+	d.set(req.Name, AnomalyPlateau, d.plateau(samples, now))
+	d.set(req.Name, AnomalyExecDrop, d.execDrop(samples, now))
+	d.set(req.Name, AnomalyCrashSpike, d.crashSpike(samples, now))
+}
+
+// plateau finds coverage that did not grow for the plateau window.
+func (d *anomalyDetector) plateau(samples []statsSample, now time.Time) string {
+	start, ok := sampleAt(samples, now.Add(-d.conf.PlateauWindow))
+	if !ok {
+		return ""
+	}
+	if cur := samples[len(samples)-1]; cur.cover <= start.cover {
+		return fmt.Sprintf("coverage stayed at %d for %v", cur.cover, d.conf.PlateauWindow)
+	}
+	return ""
+}
+
+// execDrop finds a recent exec rate far below the baseline one.
+func (d *anomalyDetector) execDrop(samples []statsSample, now time.Time) string {
+	recent, baseline, ok := d.rates(samples, now, func(s statsSample) uint64 { return s.execs })
+	if !ok || baseline == 0 || recent >= baseline*d.conf.ExecDrop {
+		return ""
+	}
+	return fmt.Sprintf("exec rate %.1f/s down from %.1f/s", recent, baseline)
+}
+
+// crashSpike finds a recent crash rate far above the baseline one.
+func (d *anomalyDetector) crashSpike(samples []statsSample, now time.Time) string {
+	recent, baseline, ok := d.rates(samples, now, func(s statsSample) uint64 { return s.crashes })
+	if !ok || recent*d.conf.RecentWindow.Seconds() < float64(d.conf.MinCrashes) ||
+		recent <= baseline*d.conf.CrashSpike {
+		return ""
+	}
+	return fmt.Sprintf("crash rate %.1f/h up from %.1f/h", recent*3600, baseline*3600)
+}
+
+// rates returns the per second rates of a delta in the recent and baseline
+// windows, it fails when the samples do not cover both windows.
+func (d *anomalyDetector) rates(samples []statsSample, now time.Time, delta func(statsSample) uint64) (float64, float64, bool) {
+	var (
+		split    = now.Add(-d.conf.RecentWindow)
+		start    = split.Add(-d.conf.BaselineWindow)
+		recent   uint64
+		baseline uint64
+	)
+	if _, ok := sampleAt(samples, start); !ok {
+		return 0, 0, false
+	}
+	// Deltas cover the time since the previous sample, the first sample
+	// before the start only marks the start.
+	for _, s := range samples {
+		switch {
+		case !s.time.After(start):
+		case s.time.After(split):
+			recent += delta(s)
+		default:
+			baseline += delta(s)
+		}
+	}
+	return float64(recent) / d.conf.RecentWindow.Seconds(),
+		float64(baseline) / d.conf.BaselineWindow.Seconds(), true
+}
+
+// sampleAt returns the last sample at or before t.
+func sampleAt(samples []statsSample, t time.Time) (statsSample, bool) {
+	var (
+		res statsSample
+		ok  bool
+	)
+	for _, s := range samples {
+		if s.time.After(t) {
+			break
+		}
+		res, ok = s, true
+	}
+	return res, ok
+}
+
+// set records whether a manager has an anomaly, detail is empty if not.
+func (d *anomalyDetector) set(manager, kind, detail string) {
+	key := [2]string{manager, kind}
+	a, active := d.findings[key]
+	switch {
+	case detail != "" && !active:
+		d.findings[key] = &anomaly{manager, kind, time.Now(), detail}
+		d.metrics.managerAnomalyGauges.WithLabelValues(manager, kind).Set(1)
+		d.metrics.managerAnomalyCounters.WithLabelValues(manager, kind).Inc()
+		d.log.Warn("manager anomaly", "manager", manager, "kind", kind, "detail", detail)
+	case detail != "":
+		a.Detail = detail
+	case active:
+		delete(d.findings, key)
+		d.metrics.managerAnomalyGauges.WithLabelValues(manager, kind).Set(0)
+		d.log.Info("manager anomaly cleared", "manager", manager, "kind", kind, "duration", time.Since(a.Since))
+	}
+}
+
+// expire clears the anomalies of managers that stopped uploading stats and
+// forgets their samples.
+func (d *anomalyDetector) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cutoff := time.Now().Add(-d.conf.history())
+	for manager, samples := range d.samples {
+		if samples[len(samples)-1].time.After(cutoff) {
+			continue
+		}
+		delete(d.samples, manager)
+		for _, kind := range anomalyKinds {
+			d.set(manager, kind, "")
+		}
+	}
+}
+
+// forget forgets a removed manager, its metrics are already deleted.
+func (d *anomalyDetector) forget(manager string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.samples, manager)
+	for _, kind := range anomalyKinds {
+		delete(d.findings, [2]string{manager, kind})
+	}
+}
+
+// list returns the active anomalies.
+func (d *anomalyDetector) list() []anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := []anomaly{}
+	for _, a := range d.findings {
+		res = append(res, *a)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Manager != res[j].Manager {
+			return res[i].Manager < res[j].Manager
+		}
+		return res[i].Kind < res[j].Kind
+	})
+	return res
+}
+
+// Anomalies returns the active anomalies of managers.
+func (p *proxy) Anomalies(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":   p.anomalies.conf.Enabled,
+		"anomalies": p.anomalies.list(),
+	})
+}
@@ -0,0 +1,168 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestAnomalyDetector(t *testing.T) *anomalyDetector {
+	conf := AnomalyConfig{Enabled: true}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMetrics(MetricsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newAnomalyDetector(conf, slog.New(slog.NewTextHandler(io.Discard, nil)), m)
+}
+
+// testSamples returns a sample every 30 minutes over the last span, sample
+// is called with the age of each sample.
+func testSamples(now time.Time, span time.Duration, sample func(age time.Duration) statsSample) []statsSample {
+	var samples []statsSample
+	for age := span; age >= 0; age -= 30 * time.Minute {
+		s := sample(age)
+		s.time = now.Add(-age)
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+func TestAnomalyWindows(t *testing.T) {
+	d := newTestAnomalyDetector(t)
+	now := time.Now()
+	for _, test := range []struct {
+		name    string
+		check   func([]statsSample, time.Time) string
+		samples []statsSample
+		found   bool
+	}{
+		{
+			name:  "plateau",
+			check: d.plateau,
+			samples: testSamples(now, 7*time.Hour, func(time.Duration) statsSample {
+				return statsSample{cover: 100}
+			}),
+			found: true,
+		},
+		{
+			name:  "growing coverage",
+			check: d.plateau,
+			samples: testSamples(now, 7*time.Hour, func(age time.Duration) statsSample {
+				return statsSample{cover: uint64((7*time.Hour - age) / time.Minute)}
+			}),
+		},
+		{
+			name:  "plateau shorter than the window",
+			check: d.plateau,
+			samples: testSamples(now, 5*time.Hour, func(time.Duration) statsSample {
+				return statsSample{cover: 100}
+			}),
+		},
+		{
+			name:  "exec drop",
+			check: d.execDrop,
+			samples: testSamples(now, 7*time.Hour, func(age time.Duration) statsSample {
+				if age < 30*time.Minute {
+					return statsSample{execs: 300}
+				}
+				return statsSample{execs: 1800}
+			}),
+			found: true,
+		},
+		{
+			name:  "steady execs",
+			check: d.execDrop,
+			samples: testSamples(now, 7*time.Hour, func(time.Duration) statsSample {
+				return statsSample{execs: 1800}
+			}),
+		},
+		{
+			name:  "exec drop without a baseline",
+			check: d.execDrop,
+			samples: testSamples(now, 6*time.Hour, func(age time.Duration) statsSample {
+				if age < 30*time.Minute {
+					return statsSample{execs: 300}
+				}
+				return statsSample{execs: 1800}
+			}),
+		},
+		{
+			name:  "crash spike",
+			check: d.crashSpike,
+			samples: testSamples(now, 7*time.Hour, func(age time.Duration) statsSample {
+				if age < 30*time.Minute {
+					return statsSample{crashes: 10}
+				}
+				return statsSample{crashes: 1}
+			}),
+			found: true,
+		},
+		{
+			name:  "crash spike below min_crashes",
+			check: d.crashSpike,
+			samples: testSamples(now, 7*time.Hour, func(age time.Duration) statsSample {
+				if age < 30*time.Minute {
+					return statsSample{crashes: 4}
+				}
+				return statsSample{}
+			}),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			detail := test.check(test.samples, now)
+			if found := detail != ""; found != test.found {
+				t.Errorf("got anomaly %q, want found %v", detail, test.found)
+			}
+		})
+	}
+}
+
+func TestAnomalyForget(t *testing.T) {
+	d := newTestAnomalyDetector(t)
+	d.samples["m"] = []statsSample{{time: time.Now().Add(-24 * time.Hour)}}
+	d.set("m", AnomalyPlateau, "coverage stayed at 0")
+	if n := len(d.list()); n != 1 {
+		t.Fatalf("got %v anomalies, want 1", n)
+	}
+
+	// A silent manager's anomalies are cleared, a removed manager is
+	// forgotten without touching its deleted metrics.
+	d.expire()
+	if n := len(d.list()); n != 0 {
+		t.Fatalf("got %v anomalies after expiry, want 0", n)
+	}
+	if v := testutil.ToFloat64(d.metrics.managerAnomalyGauges.WithLabelValues("m", AnomalyPlateau)); v != 0 {
+		t.Errorf("got anomaly gauge %v, want 0", v)
+	}
+	d.samples["m"] = []statsSample{{time: time.Now().Add(-24 * time.Hour)}}
+	d.set("m", AnomalyExecDrop, "exec rate down")
+	d.metrics.deleteManagerSeries("m")
+	d.forget("m")
+	d.expire()
+	if n := len(d.list()); n != 0 {
+		t.Errorf("got %v anomalies after forget, want 0", n)
+	}
+	if n := len(collectSeries(t, d.metrics.managerAnomalyGauges)); n != 0 {
+		t.Errorf("got %v anomaly series after forget, want 0", n)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import "time"
+
+// defaultBugOriginTTL is how long the upstream of a bug is remembered by
+// default.
+const defaultBugOriginTTL = 90 * 24 * time.Hour
+
+// BugsConfig configures bug routing.
+type BugsConfig struct {
+	// OriginTTL is how long the upstream that reported a bug is
+	// remembered, it defaults to 90 days.
+	OriginTTL time.Duration `yaml:"origin_ttl"`
+}
+
+func (conf *BugsConfig) validate() error {
+	if conf.OriginTTL == 0 {
+		conf.OriginTTL = defaultBugOriginTTL
+	}
+	return nil
+}
+
+// bugUpstreams returns the upstreams to look for a bug in, the upstream that
+// is known to own it comes first.
+func (p *proxy) bugUpstreams(id string) []string {
+	origin, ok := p.bugOrigins.get(id)
+	if !ok {
+		return p.order
+	}
+	order := []string{origin}
+	for _, addr := range p.order {
+		if addr != origin {
+			order = append(order, addr)
+		}
+	}
+	return order
+}
@@ -0,0 +1,137 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultBuildsSize is the number of builds whose manager is remembered by
+// default.
+const defaultBuildsSize = 10000
+
+// BuildsConfig configures the builds the proxy remembers.
+type BuildsConfig struct {
+	// Size is the number of builds whose manager is remembered, the oldest
+	// builds are forgotten first. It defaults to 10000.
+	Size int `yaml:"size"`
+}
+
+func (conf *BuildsConfig) validate() error {
+	if conf.Size < 0 {
+		return fmt.Errorf("builds: negative size")
+	}
+	if conf.Size == 0 {
+		conf.Size = defaultBuildsSize
+	}
+	return nil
+}
+
+// buildEntry is the manager that uploaded a build.
+type buildEntry struct {
+	Manager string    `json:"manager"`
+	Time    time.Time `json:"time"`
+}
+
+// buildStore maps build IDs to the manager that uploaded them, crashes only
+// refer to the build. It holds a bounded number of builds and is saved to a
+// file when it has one.
+type buildStore struct {
+	path string
+	size int
+	log  *slog.Logger
+
+	mu     sync.RWMutex
+	builds map[string]buildEntry
+}
+
+// newBuildStore returns a build store and loads the builds saved at path.
+func newBuildStore(path string, size int, log *slog.Logger) (*buildStore, error) {
+	s := &buildStore{
+		path:   path,
+		size:   size,
+		log:    log,
+		builds: map[string]buildEntry{},
+	}
+	if path == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.builds); err != nil {
+		return nil, err
+	}
+	s.evict()
+	return s, nil
+}
+
+// manager returns the manager of a build, it is empty when the build is
+// unknown.
+func (s *buildStore) manager(id string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.builds[id].Manager
+}
+
+// add records the manager of a build.
+func (s *buildStore) add(id, manager string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.builds[id]; ok && b.Manager == manager {
+		return
+	}
+	s.builds[id] = buildEntry{
+		Manager: manager,
+		Time:    time.Now(),
+	}
+	s.evict()
+	if s.path == "" {
+		return
+	}
+	if err := writeFileAtomic(s.path, s.builds); err != nil {
+		s.log.Error("failed to save builds", "path", s.path, "error", err)
+	}
+}
+
+// evict forgets the oldest builds over the size, the caller must hold the
+// lock.
+func (s *buildStore) evict() {
+	n := len(s.builds) - s.size
+	if n <= 0 {
+		return
+	}
+	ids := make([]string, 0, len(s.builds))
+	for id := range s.builds {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return s.builds[ids[i]].Time.Before(s.builds[ids[j]].Time)
+	})
+	for _, id := range ids[:n] {
+		delete(s.builds, id)
+	}
+}
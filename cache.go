@@ -0,0 +1,203 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultCacheSize is the default number of cached responses of a method.
+const defaultCacheSize = 1000
+
+// cacheInvalidations are the cached methods whose responses a write may
+// change.
+var cacheInvalidations = map[string][]string{
+	"upload_commits":   {"commit_poll"},
+	"reporting_update": {"bug_list", "load_bug"},
+}
+
+// cacheable are the methods whose responses can be cached.
+var cacheable = map[string]bool{
+	"commit_poll": true,
+	"bug_list":    true,
+	"load_bug":    true,
+}
+
+// CacheConfig configures the response cache of a method.
+type CacheConfig struct {
+	// TTL is how long responses are cached.
+	TTL time.Duration `yaml:"ttl"`
+	// Size is the number of cached responses, the least recently used
+	// ones are evicted first.
+	Size int `yaml:"size"`
+}
+
+func (conf *CacheConfig) validate(method string) error {
+	if !cacheable[method] {
+		return fmt.Errorf("cache: method %s can not be cached", method)
+	}
+	if conf.TTL <= 0 {
+		return fmt.Errorf("cache %s: missing ttl", method)
+	}
+	if conf.Size < 0 {
+		return fmt.Errorf("cache %s: negative size", method)
+	}
+	if conf.Size == 0 {
+		conf.Size = defaultCacheSize
+	}
+	return nil
+}
+
+// cacheEntry is a cached json response.
+type cacheEntry struct {
+	key     string
+	resp    []byte
+	expires time.Time
+}
+
+// methodCache is the LRU cache of the responses of a method.
+type methodCache struct {
+	conf    CacheConfig
+	lru     *list.List
+	entries map[string]*list.Element
+	// gen is the generation of the cache, it changes on every
+	// invalidation.
+	gen uint64
+}
+
+// responseCache caches the responses of read only methods by method and
+// request.
+type responseCache struct {
+	metrics *metrics
+
+	mu      sync.Mutex
+	methods map[string]*methodCache
+}
+
+func newResponseCache(conf map[string]CacheConfig, m *metrics) *responseCache {
+	rc := &responseCache{metrics: m, methods: map[string]*methodCache{}}
+	for method, mc := range conf {
+		rc.methods[method] = &methodCache{
+			conf:    mc,
+			lru:     list.New(),
+			entries: map[string]*list.Element{},
+		}
+	}
+	return rc
+}
+
+// cacheKey returns the cache key of a request.
+func cacheKey(req interface{}) string {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// get returns a cached response, on a miss it returns the generation of the
+// cache to put the response with.
+func (rc *responseCache) get(method, key string) ([]byte, uint64, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	mc, ok := rc.methods[method]
+	if !ok {
+		return nil, 0, false
+	}
+	el, ok := mc.entries[key]
+	if !ok {
+		rc.metrics.cacheCounters.WithLabelValues(method, "miss").Inc()
+		return nil, mc.gen, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		mc.lru.Remove(el)
+		delete(mc.entries, key)
+		rc.metrics.cacheEntriesGauges.WithLabelValues(method).Set(float64(mc.lru.Len()))
+		rc.metrics.cacheCounters.WithLabelValues(method, "miss").Inc()
+		return nil, mc.gen, false
+	}
+	mc.lru.MoveToFront(el)
+	rc.metrics.cacheCounters.WithLabelValues(method, "hit").Inc()
+	return e.resp, mc.gen, true
+}
+
+// put caches a response of the generation of the cache the lookup missed
+// in. A response of an earlier generation may predate an invalidating write
+// and is not cached.
+func (rc *responseCache) put(method, key string, gen uint64, resp interface{}) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	mc, ok := rc.methods[method]
+	if !ok || mc.gen != gen {
+		return
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	e := &cacheEntry{key, b, time.Now().Add(mc.conf.TTL)}
+	if el, ok := mc.entries[key]; ok {
+		el.Value = e
+		mc.lru.MoveToFront(el)
+		return
+	}
+	mc.entries[key] = mc.lru.PushFront(e)
+	for mc.lru.Len() > mc.conf.Size {
+		el := mc.lru.Back()
+		mc.lru.Remove(el)
+		delete(mc.entries, el.Value.(*cacheEntry).key)
+	}
+	rc.metrics.cacheEntriesGauges.WithLabelValues(method).Set(float64(mc.lru.Len()))
+}
+
+// invalidate drops the cached responses that a write may change.
+func (rc *responseCache) invalidate(write string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, method := range cacheInvalidations[write] {
+		mc, ok := rc.methods[method]
+		if !ok {
+			continue
+		}
+		mc.gen++
+		if mc.lru.Len() == 0 {
+			continue
+		}
+		mc.lru.Init()
+		mc.entries = map[string]*list.Element{}
+		rc.metrics.cacheEntriesGauges.WithLabelValues(method).Set(0)
+		rc.metrics.cacheInvalidationCounters.WithLabelValues(method, write).Inc()
+	}
+}
+
+// cached responds to a request from the cache, it returns false on a miss
+// along with the generation to put the response with.
+func (p *proxy) cached(c *gin.Context, method, key string) (uint64, bool) {
+	resp, gen, ok := p.cache.get(method, key)
+	if !ok {
+		return gen, false
+	}
+	p.logger(c).Debug("cache hit")
+	c.Data(http.StatusOK, "application/json; charset=utf-8", resp)
+	return gen, true
+}
@@ -0,0 +1,76 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	m, err := newMetrics(MetricsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := newResponseCache(map[string]CacheConfig{
+		"load_bug": {TTL: time.Hour, Size: 2},
+		"bug_list": {TTL: time.Nanosecond, Size: 1},
+	}, m)
+	hit := func(method, key string) bool {
+		_, _, ok := rc.get(method, key)
+		return ok
+	}
+
+	_, gen, _ := rc.get("load_bug", "a")
+	rc.put("load_bug", "a", gen, "bug a")
+	if resp, _, ok := rc.get("load_bug", "a"); !ok || string(resp) != `"bug a"` {
+		t.Errorf("got cached %q, want bug a", resp)
+	}
+	// The least recently used response is evicted.
+	rc.put("load_bug", "b", gen, "bug b")
+	rc.get("load_bug", "a")
+	rc.put("load_bug", "c", gen, "bug c")
+	if !hit("load_bug", "a") || hit("load_bug", "b") || !hit("load_bug", "c") {
+		t.Errorf("got wrong response evicted")
+	}
+	// Expired responses are not served.
+	_, listGen, _ := rc.get("bug_list", "")
+	rc.put("bug_list", "", listGen, "bugs")
+	time.Sleep(time.Millisecond)
+	if hit("bug_list", "") {
+		t.Errorf("expired response served")
+	}
+	// A write drops the responses it may change, and responses of reads that
+	// started before it are not cached.
+	_, gen, _ = rc.get("load_bug", "d")
+	rc.invalidate("reporting_update")
+	if hit("load_bug", "a") {
+		t.Errorf("response served after invalidation")
+	}
+	rc.put("load_bug", "d", gen, "stale bug d")
+	if hit("load_bug", "d") {
+		t.Errorf("response of a read before the invalidation cached")
+	}
+	_, gen, _ = rc.get("load_bug", "d")
+	rc.put("load_bug", "d", gen, "bug d")
+	if !hit("load_bug", "d") {
+		t.Errorf("response of a read after the invalidation not cached")
+	}
+	// Other writes leave the cache alone.
+	rc.invalidate("upload_commits")
+	if !hit("load_bug", "d") {
+		t.Errorf("unrelated write dropped the response")
+	}
+}
@@ -15,8 +15,12 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	proxy "github.com/hodgesds/syz-dashboard-proxy"
@@ -24,8 +28,15 @@ import (
 )
 
 var (
-	port    int
-	forward []string
+	port       int
+	forward    []string
+	configPath string
+	logFormat  string
+	logLevel   string
+
+	traceExporter string
+	traceEndpoint string
+	traceFile     string
 )
 
 // RootCmd represents the base command when called without any subcommands
@@ -34,10 +45,47 @@ var RootCmd = &cobra.Command{
 	Short: "",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		proxy := proxy.New(forward)
-		r := gin.Default()
+		log, err := proxy.NewLogger(os.Stderr, logFormat, logLevel)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+		conf := &proxy.Config{}
+		if configPath != "" {
+			conf, err = proxy.LoadConfig(configPath)
+			if err != nil {
+				log.Error("failed to load config", "path", configPath, "error", err)
+				os.Exit(-1)
+			}
+		}
+		conf.Logger = log
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if traceExporter != "none" {
+			tp, err := proxy.NewTracerProvider(ctx, traceExporter, traceEndpoint, traceFile)
+			if err != nil {
+				log.Error("failed to create tracer provider", "error", err)
+				os.Exit(-1)
+			}
+			defer tp.Shutdown(context.Background())
+			conf.TracerProvider = tp
+		}
+		proxy, err := proxy.New(forward, conf)
+		if err != nil {
+			log.Error("failed to create proxy", "error", err)
+			os.Exit(-1)
+		}
+		defer proxy.Close()
+		r := gin.New()
+		r.Use(gin.Recovery())
 		r.POST("/api", proxy.Proxy)
 		r.GET("/metrics", proxy.Metrics)
+		r.GET("/repro_budget", proxy.ReproBudget)
+		r.GET("/managers", proxy.Managers)
+		r.GET("/history", proxy.History)
+		r.GET("/anomalies", proxy.Anomalies)
+		r.GET("/local_crashes", proxy.LocalCrashes)
 		r.POST("/null", func(c *gin.Context) {
 			c.JSON(200, gin.H{
 				"message": "ok",
@@ -48,7 +96,17 @@ var RootCmd = &cobra.Command{
 				"message": "ok",
 			})
 		})
-		r.Run(fmt.Sprintf(":%d", port))
+		srv := &http.Server{
+			Addr:    fmt.Sprintf(":%d", port),
+			Handler: r,
+		}
+		go func() {
+			<-ctx.Done()
+			srv.Shutdown(context.Background())
+		}()
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Error("server failed", "error", err)
+		}
 	},
 }
 
@@ -72,4 +130,34 @@ func init() {
 		[]string{},
 		"Proxy forward",
 	)
+	RootCmd.PersistentFlags().StringVarP(
+		&configPath, "config", "c",
+		"",
+		"Config file",
+	)
+	RootCmd.PersistentFlags().StringVar(
+		&logFormat, "log-format",
+		"logfmt",
+		"Log format (json or logfmt)",
+	)
+	RootCmd.PersistentFlags().StringVar(
+		&logLevel, "log-level",
+		"info",
+		"Log level (debug, info, warn or error)",
+	)
+	RootCmd.PersistentFlags().StringVar(
+		&traceExporter, "trace-exporter",
+		"none",
+		"Trace exporter (none, otlp or file)",
+	)
+	RootCmd.PersistentFlags().StringVar(
+		&traceEndpoint, "trace-endpoint",
+		"",
+		"OTLP/HTTP collector endpoint, e.g. http://localhost:4318",
+	)
+	RootCmd.PersistentFlags().StringVar(
+		&traceFile, "trace-file",
+		"traces.json",
+		"File the file trace exporter writes to",
+	)
 }
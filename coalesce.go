@@ -0,0 +1,36 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// coalesce calls fn once for identical concurrent requests of a method and
+// shares its result between them. The upstream calls run in the context of
+// the first request.
+func coalesce[T any](p *proxy, c *gin.Context, method string, req interface{}, fn func() (T, error)) (T, error) {
+	leader := false
+	v, err, _ := p.flights.Do(method+"\x00"+cacheKey(req), func() (interface{}, error) {
+		leader = true
+		return fn()
+	})
+	if !leader {
+		p.metrics.coalescedCounters.WithLabelValues(method).Inc()
+		p.logger(c).Debug("request coalesced")
+	}
+	res, _ := v.(T)
+	return res, err
+}
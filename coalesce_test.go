@@ -0,0 +1,64 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCoalesce(t *testing.T) {
+	const polls = 5
+	upstream := newFakeDashboard(t)
+	upstream.hold = make(chan struct{})
+	upstream.setResponse("builder_poll", `{"PendingCommits": ["abc"]}`)
+	p, client := newTestProxy(t, nil, upstream)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, polls)
+	for i := 0; i < polls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.BuilderPoll("m")
+			if err == nil && len(resp.PendingCommits) != 1 {
+				t.Errorf("got pending commits %q, want [abc]", resp.PendingCommits)
+			}
+			errs <- err
+		}()
+	}
+	// The first poll reaches the upstream, the others wait for its answer.
+	for upstream.called() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(upstream.hold)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := upstream.called(); n != 1 {
+		t.Errorf("upstream got %v calls, want 1", n)
+	}
+	if n := testutil.ToFloat64(p.metrics.coalescedCounters.WithLabelValues("builder_poll")); n != polls-1 {
+		t.Errorf("got %v coalesced polls, want %v", n, polls-1)
+	}
+}
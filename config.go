@@ -0,0 +1,93 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the proxy configuration.
+type Config struct {
+	// Logger is the proxy logger, by default nothing is logged.
+	Logger *slog.Logger `yaml:"-"`
+	// TracerProvider traces API calls, by default nothing is traced.
+	TracerProvider trace.TracerProvider `yaml:"-"`
+	// Registry registers the proxy metrics, by default every proxy has its
+	// own registry.
+	Registry *prometheus.Registry `yaml:"-"`
+	Metrics  MetricsConfig        `yaml:"metrics"`
+
+	// StateDir is where state that survives restarts is kept, nothing is
+	// kept when it is empty.
+	StateDir string `yaml:"state_dir"`
+
+	RateLimits []RateLimit `yaml:"rate_limits"`
+	// Upstreams configures upstreams by their forward address.
+	Upstreams map[string]UpstreamConfig `yaml:"upstreams"`
+	// CrashRules filter reported crashes, the first matching rule wins.
+	CrashRules   []*CrashRule       `yaml:"crash_rules"`
+	LocalCrashes LocalCrashesConfig `yaml:"local_crashes"`
+	Builds       BuildsConfig       `yaml:"builds"`
+	Jobs         JobsConfig         `yaml:"jobs"`
+	Bugs         BugsConfig         `yaml:"bugs"`
+	NeedRepro    ReproConfig        `yaml:"need_repro"`
+	ReproBudget  ReproBudgetConfig  `yaml:"repro_budget"`
+	// WritePolicies are the write policies by API method, the default key
+	// sets the policy of methods without one.
+	WritePolicies map[string]WritePolicy `yaml:"write_policies"`
+	Offline       OfflineConfig          `yaml:"offline"`
+	// Cache configures the response caches by API method.
+	Cache     map[string]CacheConfig `yaml:"cache"`
+	Managers  ManagersConfig         `yaml:"managers"`
+	History   HistoryConfig          `yaml:"history"`
+	Anomalies AnomalyConfig          `yaml:"anomalies"`
+	// ManagerLabels label managers, the first matching rule wins.
+	ManagerLabels []*ManagerLabels `yaml:"manager_labels"`
+}
+
+// UpstreamConfig is the configuration of an upstream dashboard.
+type UpstreamConfig struct {
+	// Rewrite rules are applied in order to every request forwarded to
+	// the upstream.
+	Rewrite []*Rewrite `yaml:"rewrite"`
+}
+
+// LoadConfig loads a YAML config from a file.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &Config{}
+	if err := yaml.UnmarshalStrict(b, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// statePath returns the path of a state file, or an empty path when state
+// is not kept.
+func (conf *Config) statePath(name string) string {
+	if conf.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(conf.StateDir, name)
+}
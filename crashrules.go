@@ -0,0 +1,85 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Crash rule actions.
+const (
+	// CrashDrop discards the crash.
+	CrashDrop = "drop"
+	// CrashDowngrade forwards the crash as corrupted and without a
+	// reproducer so it is not reported as a new bug.
+	CrashDowngrade = "downgrade"
+	// CrashLocal keeps the crash in the proxy but does not forward it.
+	CrashLocal = "local"
+)
+
+// CrashRule matches crashes reported by managers.
+type CrashRule struct {
+	Name string `yaml:"name"`
+	// Title and Manager are regexps matched against the crash title and
+	// the manager that reported it, an empty regexp matches everything.
+	// Rules on managers do not match crashes whose manager is unknown.
+	Title   string `yaml:"title"`
+	Manager string `yaml:"manager"`
+	// Action is what happens to matching crashes: drop, downgrade or
+	// local.
+	Action string `yaml:"action"`
+
+	title   *regexp.Regexp
+	manager *regexp.Regexp
+}
+
+func (r *CrashRule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("crash rule: missing name")
+	}
+	switch r.Action {
+	case CrashDrop, CrashDowngrade, CrashLocal:
+	default:
+		return fmt.Errorf("crash rule %s: unknown action %q", r.Name, r.Action)
+	}
+	var err error
+	if r.title, err = regexp.Compile(r.Title); err != nil {
+		return fmt.Errorf("crash rule %s: %v", r.Name, err)
+	}
+	if r.manager, err = regexp.Compile(r.Manager); err != nil {
+		return fmt.Errorf("crash rule %s: %v", r.Name, err)
+	}
+	return nil
+}
+
+// matchManager matches the manager regexp of a rule, a manager that is
+// unknown only matches rules without one.
+func matchManager(expr string, re *regexp.Regexp, manager string) bool {
+	if expr == "" {
+		return true
+	}
+	return manager != "" && re.MatchString(manager)
+}
+
+// matchCrash returns the first crash rule that matches a crash, if any.
+func (p *proxy) matchCrash(title, manager string) *CrashRule {
+	for _, r := range p.crashRules {
+		if r.title.MatchString(title) && matchManager(r.Manager, r.manager, manager) {
+			return r
+		}
+	}
+	return nil
+}
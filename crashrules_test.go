@@ -0,0 +1,128 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+func TestCrashRules(t *testing.T) {
+	upstream := newFakeDashboard(t)
+	upstream.setResponse("report_crash", `{"NeedRepro": true}`)
+	upstream.setResponse("need_repro", `{"NeedRepro": true}`)
+	p, client := newTestProxy(t, &Config{
+		CrashRules: []*CrashRule{
+			{Name: "noise", Title: "^lost connection", Action: CrashDrop},
+			{Name: "ours", Title: "^WARNING", Manager: "^ci-", Action: CrashLocal},
+			{Name: "flaky", Title: "^INFO", Action: CrashDowngrade},
+		},
+	}, upstream)
+	if err := client.UploadBuild(&dashapi.Build{ID: "b1", Manager: "ci-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		crash dashapi.Crash
+		// forwarded is whether the crash reaches the upstream and local
+		// whether it is kept in the proxy.
+		forwarded  bool
+		local      bool
+		downgraded bool
+		needRepro  bool
+	}{
+		{
+			name:  "drop",
+			crash: dashapi.Crash{BuildID: "b1", Title: "lost connection to test machine"},
+		},
+		{
+			name:  "local",
+			crash: dashapi.Crash{BuildID: "b1", Title: "WARNING in foo"},
+			local: true,
+		},
+		{
+			// The manager of an unknown build does not match rules on
+			// managers.
+			name:      "unknown build",
+			crash:     dashapi.Crash{BuildID: "b2", Title: "WARNING in bar"},
+			forwarded: true,
+			needRepro: true,
+		},
+		{
+			name:       "downgrade",
+			crash:      dashapi.Crash{BuildID: "b1", Title: "INFO: task hung", ReproSyz: []byte("r0 = open()")},
+			forwarded:  true,
+			downgraded: true,
+		},
+		{
+			name:      "no rule",
+			crash:     dashapi.Crash{BuildID: "b1", Title: "KASAN: use-after-free"},
+			forwarded: true,
+			needRepro: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			forwarded := len(upstream.payloads("report_crash"))
+			local := len(p.localCrashes.list())
+			resp, err := client.ReportCrash(&test.crash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.NeedRepro != test.needRepro {
+				t.Errorf("got need repro %v, want %v", resp.NeedRepro, test.needRepro)
+			}
+			payloads := upstream.payloads("report_crash")
+			if got := len(payloads) > forwarded; got != test.forwarded {
+				t.Fatalf("got forwarded %v, want %v", got, test.forwarded)
+			}
+			if got := len(p.localCrashes.list()) > local; got != test.local {
+				t.Errorf("got kept locally %v, want %v", got, test.local)
+			}
+			if !test.forwarded {
+				return
+			}
+			var sent dashapi.Crash
+			if err := json.Unmarshal([]byte(payloads[len(payloads)-1]), &sent); err != nil {
+				t.Fatal(err)
+			}
+			if sent.Corrupted != test.downgraded {
+				t.Errorf("got corrupted %v, want %v", sent.Corrupted, test.downgraded)
+			}
+			if test.downgraded && len(sent.ReproSyz) != 0 {
+				t.Errorf("downgraded crash forwarded with repro %q", sent.ReproSyz)
+			}
+		})
+	}
+
+	// Crashes matching a rule are never reproduced.
+	for _, id := range []dashapi.CrashID{
+		{BuildID: "b1", Title: "lost connection to test machine"},
+		{BuildID: "b1", Title: "INFO: task hung"},
+	} {
+		needRepro, err := client.NeedRepro(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if needRepro {
+			t.Errorf("%s: got need repro, want none", id.Title)
+		}
+	}
+	if n := len(upstream.payloads("need_repro")); n != 0 {
+		t.Errorf("upstream asked %v times, want 0", n)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// ManagerLabels labels the managers whose name matches a regexp, labels are
+// added to manager_info and break down the fleet metrics.
+type ManagerLabels struct {
+	Manager    string `yaml:"manager"`
+	Team       string `yaml:"team"`
+	Cluster    string `yaml:"cluster"`
+	KernelTree string `yaml:"kernel_tree"`
+
+	manager *regexp.Regexp
+}
+
+func (l *ManagerLabels) compile() error {
+	re, err := regexp.Compile(l.Manager)
+	if err != nil {
+		return fmt.Errorf("manager labels %q: %v", l.Manager, err)
+	}
+	l.manager = re
+	return nil
+}
+
+// enrich sets the labels of a manager from the first matching rule.
+func (r *managerRegistry) enrich(m *managerInfo) {
+	m.Team, m.Cluster, m.KernelTree = "", "", ""
+	for _, l := range r.labels {
+		if l.manager.MatchString(m.Name) {
+			m.Team, m.Cluster, m.KernelTree = l.Team, l.Cluster, l.KernelTree
+			return
+		}
+	}
+}
+
+// fleet is the aggregate of the managers with the same labels.
+type fleet struct {
+	managers       int
+	corpus         uint64
+	cover          uint64
+	execsPerSecond float64
+}
+
+// aggregate updates the fleet metrics from the managers that are up, the
+// caller must hold the lock.
+func (r *managerRegistry) aggregate() {
+	fleets := map[[3]string]*fleet{}
+	for _, m := range r.managers {
+		if !m.Up {
+			continue
+		}
+		key := [3]string{m.Team, m.Cluster, m.KernelTree}
+		f, ok := fleets[key]
+		if !ok {
+			f = &fleet{}
+			fleets[key] = f
+		}
+		f.managers++
+		f.corpus += m.Corpus
+		f.cover += m.Cover
+		f.execsPerSecond += m.ExecsPerSecond
+	}
+	var managers, corpus, cover, execRate []gaugeSeries
+	for key, f := range fleets {
+		labels := []string{key[0], key[1], key[2]}
+		managers = append(managers, gaugeSeries{labels, float64(f.managers)})
+		corpus = append(corpus, gaugeSeries{labels, float64(f.corpus)})
+		cover = append(cover, gaugeSeries{labels, float64(f.cover)})
+		execRate = append(execRate, gaugeSeries{labels, f.execsPerSecond})
+	}
+	r.metrics.fleetManagersGauges.replace(managers)
+	r.metrics.fleetCorpusGauges.replace(corpus)
+	r.metrics.fleetCoverageGauges.replace(cover)
+	r.metrics.fleetExecRateGauges.replace(execRate)
+}
@@ -0,0 +1,328 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+const (
+	// defaultHistoryRetention is how long full resolution points are kept
+	// by default.
+	defaultHistoryRetention = 7 * 24 * time.Hour
+	// defaultHistoryDownsample is the default period older points are
+	// merged into.
+	defaultHistoryDownsample = time.Hour
+	// defaultHistoryDownsampleRetention is how long downsampled points are
+	// kept by default.
+	defaultHistoryDownsampleRetention = 365 * 24 * time.Hour
+	// historyCompactInterval is how often history files are downsampled.
+	historyCompactInterval = time.Hour
+	// historyPointSize is the size of an encoded point.
+	historyPointSize = 6 * 8
+)
+
+var (
+	errNoHistory = errors.New("stats history is disabled")
+)
+
+// HistoryConfig configures the manager stats history.
+type HistoryConfig struct {
+	// Enabled keeps the history in the state dir.
+	Enabled bool `yaml:"enabled"`
+	// Retention is how long points are kept at full resolution, it
+	// defaults to a week.
+	Retention time.Duration `yaml:"retention"`
+	// Downsample is the period older points are merged into, it defaults
+	// to an hour.
+	Downsample time.Duration `yaml:"downsample"`
+	// DownsampleRetention is how long merged points are kept, it defaults
+	// to a year.
+	DownsampleRetention time.Duration `yaml:"downsample_retention"`
+}
+
+func (conf *HistoryConfig) validate(stateDir string) error {
+	if conf.Enabled && stateDir == "" {
+		return fmt.Errorf("history: missing state_dir")
+	}
+	if conf.Retention == 0 {
+		conf.Retention = defaultHistoryRetention
+	}
+	if conf.Downsample == 0 {
+		conf.Downsample = defaultHistoryDownsample
+	}
+	if conf.DownsampleRetention == 0 {
+		conf.DownsampleRetention = defaultHistoryDownsampleRetention
+	}
+	if conf.Retention < 0 || conf.Downsample < 0 || conf.DownsampleRetention < conf.Retention {
+		return fmt.Errorf("history: downsample_retention %v shorter than retention %v",
+			conf.DownsampleRetention, conf.Retention)
+	}
+	return nil
+}
+
+// historyPoint is a manager stats upload. Corpus, PCs and Cover are levels,
+// Execs and Crashes are deltas since the previous point.
+type historyPoint struct {
+	Time    time.Time `json:"time"`
+	Corpus  uint64    `json:"corpus"`
+	PCs     uint64    `json:"pcs"`
+	Cover   uint64    `json:"cover"`
+	Execs   uint64    `json:"execs"`
+	Crashes uint64    `json:"crashes"`
+}
+
+func (pt historyPoint) encode() []byte {
+	b := make([]byte, historyPointSize)
+	for i, v := range []uint64{uint64(pt.Time.Unix()), pt.Corpus, pt.PCs, pt.Cover, pt.Execs, pt.Crashes} {
+		binary.LittleEndian.PutUint64(b[i*8:], v)
+	}
+	return b
+}
+
+func decodeHistoryPoint(b []byte) historyPoint {
+	v := func(i int) uint64 { return binary.LittleEndian.Uint64(b[i*8:]) }
+	return historyPoint{
+		Time:    time.Unix(int64(v(0)), 0).UTC(),
+		Corpus:  v(1),
+		PCs:     v(2),
+		Cover:   v(3),
+		Execs:   v(4),
+		Crashes: v(5),
+	}
+}
+
+// historyStore keeps the stats history of every manager in a file of fixed
+// size points per manager.
+type historyStore struct {
+	conf HistoryConfig
+	dir  string
+	log  *slog.Logger
+
+	mu sync.Mutex
+}
+
+func newHistoryStore(conf HistoryConfig, dir string, log *slog.Logger) (*historyStore, error) {
+	if !conf.Enabled {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &historyStore{
+		conf: conf,
+		dir:  dir,
+		log:  log,
+	}, nil
+}
+
+func (h *historyStore) path(manager string) string {
+	return filepath.Join(h.dir, url.PathEscape(manager)+".bin")
+}
+
+// add appends the stats of a manager to its history.
+func (h *historyStore) add(req *dashapi.ManagerStatsReq) {
+	if h == nil {
+		return
+	}
+	pt := historyPoint{
+		Time:    time.Now(),
+		Corpus:  req.Corpus,
+		PCs:     req.PCs,
+		Cover:   req.Cover,
+		Execs:   req.Execs,
+		Crashes: req.Crashes,
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(h.path(req.Name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err == nil {
+		_, err = f.Write(pt.encode())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		h.log.Error("failed to save stats history", "manager", req.Name, "error", err)
+	}
+}
+
+// read returns the history of a manager.
+func (h *historyStore) read(manager string) ([]historyPoint, error) {
+	b, err := ioutil.ReadFile(h.path(manager))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	points := make([]historyPoint, 0, len(b)/historyPointSize)
+	for ; len(b) >= historyPointSize; b = b[historyPointSize:] {
+		points = append(points, decodeHistoryPoint(b))
+	}
+	return points, nil
+}
+
+// query returns the history of a manager in a time range.
+func (h *historyStore) query(manager string, from, to time.Time) ([]historyPoint, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	points, err := h.read(manager)
+	if err != nil {
+		return nil, err
+	}
+	res := []historyPoint{}
+	for _, pt := range points {
+		if !pt.Time.Before(from) && !pt.Time.After(to) {
+			res = append(res, pt)
+		}
+	}
+	return res, nil
+}
+
+// compact downsamples the histories of all managers: points older than the
+// retention are merged per downsample period, keeping the last levels and
+// summing the deltas, and merged points older than their retention are
+// dropped.
+func (h *historyStore) compact() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	files, err := filepath.Glob(filepath.Join(h.dir, "*.bin"))
+	if err != nil {
+		h.log.Error("failed to list stats history", "error", err)
+		return
+	}
+	var (
+		now     = time.Now()
+		raw     = now.Add(-h.conf.Retention)
+		expired = now.Add(-h.conf.DownsampleRetention)
+	)
+	for _, file := range files {
+		manager, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(file), ".bin"))
+		if err != nil {
+			continue
+		}
+		points, err := h.read(manager)
+		if err != nil {
+			h.log.Error("failed to read stats history", "manager", manager, "error", err)
+			continue
+		}
+		var buf bytes.Buffer
+		for i := 0; i < len(points); {
+			pt := points[i]
+			i++
+			if !pt.Time.Before(raw) {
+				buf.Write(pt.encode())
+				continue
+			}
+			bucket := pt.Time.Truncate(h.conf.Downsample)
+			for ; i < len(points) && points[i].Time.Before(raw) &&
+				points[i].Time.Truncate(h.conf.Downsample).Equal(bucket); i++ {
+				pt.Corpus, pt.PCs, pt.Cover = points[i].Corpus, points[i].PCs, points[i].Cover
+				pt.Execs += points[i].Execs
+				pt.Crashes += points[i].Crashes
+			}
+			if bucket.Before(expired) {
+				continue
+			}
+			pt.Time = bucket
+			buf.Write(pt.encode())
+		}
+		if buf.Len() == 0 {
+			os.Remove(file)
+			continue
+		}
+		if err := writeRawFileAtomic(file, buf.Bytes()); err != nil {
+			h.log.Error("failed to save stats history", "manager", manager, "error", err)
+		}
+	}
+}
+
+// History serves the stats history of a manager in a time range as json or
+// csv.
+func (p *proxy) History(c *gin.Context) {
+	if p.history == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errNoHistory.Error()})
+		return
+	}
+	manager := c.Query("manager")
+	if manager == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing manager"})
+		return
+	}
+	from, err := parseHistoryTime(c.Query("from"), time.Time{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := parseHistoryTime(c.Query("to"), time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	points, err := p.history.query(manager, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, gin.H{"manager": manager, "points": points})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", manager+".csv"))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"time", "corpus", "pcs", "cover", "execs", "crashes"})
+	for _, pt := range points {
+		w.Write([]string{
+			pt.Time.Format(time.RFC3339),
+			strconv.FormatUint(pt.Corpus, 10),
+			strconv.FormatUint(pt.PCs, 10),
+			strconv.FormatUint(pt.Cover, 10),
+			strconv.FormatUint(pt.Execs, 10),
+			strconv.FormatUint(pt.Crashes, 10),
+		})
+	}
+	w.Flush()
+}
+
+// parseHistoryTime parses an RFC 3339 time or unix seconds.
+func parseHistoryTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,71 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistoryCompact(t *testing.T) {
+	h, err := newHistoryStore(HistoryConfig{
+		Enabled:             true,
+		Retention:           time.Hour,
+		Downsample:          time.Hour,
+		DownsampleRetention: 24 * time.Hour,
+	}, t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		now    = time.Now().UTC().Truncate(time.Second)
+		bucket = now.Add(-5 * time.Hour).Truncate(time.Hour)
+		old    = now.Add(-48 * time.Hour).Truncate(time.Hour)
+		recent = now.Add(-10 * time.Minute)
+	)
+	var buf bytes.Buffer
+	for _, pt := range []historyPoint{
+		// Past the downsample retention.
+		{Time: old, Corpus: 1, Execs: 1},
+		// Merged into their hour.
+		{Time: bucket.Add(10 * time.Minute), Corpus: 10, PCs: 1, Cover: 2, Execs: 100, Crashes: 1},
+		{Time: bucket.Add(20 * time.Minute), Corpus: 20, PCs: 3, Cover: 4, Execs: 200, Crashes: 2},
+		// Within the retention.
+		{Time: recent, Corpus: 30, Execs: 300},
+	} {
+		buf.Write(pt.encode())
+	}
+	if err := os.WriteFile(h.path("m"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h.compact()
+	got, err := h.read("m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []historyPoint{
+		{Time: bucket, Corpus: 20, PCs: 3, Cover: 4, Execs: 300, Crashes: 3},
+		{Time: recent, Corpus: 30, Execs: 300},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got history %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+const (
+	// defaultPendingJobTTL is how long a polled job waits for a manager
+	// before it is dropped by default.
+	defaultPendingJobTTL = time.Hour
+	// defaultJobOriginTTL is how long the upstream that issued a job is
+	// remembered by default.
+	defaultJobOriginTTL = 7 * 24 * time.Hour
+)
+
+// job_done fallbacks for jobs whose upstream is unknown.
+const (
+	// JobFallbackBroadcast sends job_done to every upstream, it succeeds
+	// if any of them accepts it.
+	JobFallbackBroadcast = "broadcast"
+	// JobFallbackPrimary sends job_done to the primary upstream.
+	JobFallbackPrimary = "primary"
+	// JobFallbackReject fails the job_done call.
+	JobFallbackReject = "reject"
+)
+
+var (
+	errUnknownJob = errors.New("unknown job")
+)
+
+// JobsConfig configures job routing.
+type JobsConfig struct {
+	// OriginTTL is how long the upstream that issued a job is remembered,
+	// it defaults to a week.
+	OriginTTL time.Duration `yaml:"origin_ttl"`
+	// Fallback is where job_done goes when the upstream that issued the
+	// job is unknown, e.g. because it expired: broadcast (the default),
+	// primary or reject.
+	Fallback string `yaml:"fallback"`
+	// PendingTTL is how long a polled job waits for a manager that can run
+	// it before it is dropped, it defaults to an hour.
+	PendingTTL time.Duration `yaml:"pending_ttl"`
+}
+
+func (conf *JobsConfig) validate(upstreams int) error {
+	if conf.OriginTTL == 0 {
+		conf.OriginTTL = defaultJobOriginTTL
+	}
+	if conf.PendingTTL == 0 {
+		conf.PendingTTL = defaultPendingJobTTL
+	}
+	switch conf.Fallback {
+	case "":
+		conf.Fallback = JobFallbackBroadcast
+	case JobFallbackPrimary:
+		if upstreams == 0 {
+			return fmt.Errorf("job fallback primary without upstreams")
+		}
+	case JobFallbackBroadcast, JobFallbackReject:
+	default:
+		return fmt.Errorf("unknown job fallback %q", conf.Fallback)
+	}
+	return nil
+}
+
+// pendingJob is a job polled from an upstream that was not handed out yet.
+type pendingJob struct {
+	Origin string               `json:"origin"`
+	Job    *dashapi.JobPollResp `json:"job"`
+	Added  time.Time            `json:"added"`
+}
+
+// jobQueue holds the jobs polled from upstreams and remembers which upstream
+// issued each job. Pending jobs are saved to a file when the queue has one.
+type jobQueue struct {
+	path string
+	ttl  time.Duration
+	log  *slog.Logger
+
+	mu    sync.Mutex
+	order []string
+	// next is the index in order of the upstream whose job is handed out
+	// next.
+	next    int
+	pending []pendingJob
+	origins *routeStore
+	metrics *metrics
+}
+
+// newJobQueue returns a job queue and loads the pending jobs saved at path.
+func newJobQueue(conf JobsConfig, path string, order []string, origins *routeStore, log *slog.Logger, m *metrics) (*jobQueue, error) {
+	q := &jobQueue{
+		path:    path,
+		ttl:     conf.PendingTTL,
+		log:     log,
+		order:   order,
+		origins: origins,
+		metrics: m,
+	}
+	if path == "" {
+		return q, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pending []pendingJob
+	if err := json.Unmarshal(b, &pending); err != nil {
+		return nil, err
+	}
+	// Jobs of upstreams that are no longer forwarded to are never handed
+	// out.
+	known := map[string]bool{}
+	for _, addr := range order {
+		known[addr] = true
+	}
+	for _, pj := range pending {
+		if !known[pj.Origin] {
+			log.Warn("pending job of unknown upstream dropped", "job", pj.Job.ID, "upstream", pj.Origin)
+			continue
+		}
+		q.pending = append(q.pending, pj)
+	}
+	return q, nil
+}
+
+// add queues a job polled from an upstream.
+func (q *jobQueue) add(origin string, job *dashapi.JobPollResp) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, pendingJob{
+		Origin: origin,
+		Job:    job,
+		Added:  time.Now(),
+	})
+	q.save()
+}
+
+// take returns the next job that one of the managers accepts and the
+// upstream that issued it, upstreams take turns in handing out jobs.
+func (q *jobQueue) take(managers map[string]dashapi.ManagerJobs) (*dashapi.JobPollResp, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	expired := q.expire()
+	for i := range q.order {
+		n := (q.next + i) % len(q.order)
+		for j, pj := range q.pending {
+			if pj.Origin != q.order[n] || !acceptsJob(managers, pj.Job) {
+				continue
+			}
+			q.pending = append(q.pending[:j], q.pending[j+1:]...)
+			q.next = (n + 1) % len(q.order)
+			q.origins.set(pj.Job.ID, pj.Origin)
+			q.save()
+			return pj.Job, pj.Origin
+		}
+	}
+	if expired {
+		q.save()
+	}
+	return nil, ""
+}
+
+// expire drops pending jobs that waited too long for a manager and returns
+// if it dropped any, the caller must hold the lock.
+func (q *jobQueue) expire() bool {
+	pending := q.pending[:0]
+	for _, pj := range q.pending {
+		if time.Since(pj.Added) > q.ttl {
+			q.metrics.jobExpiredCounters.WithLabelValues(pj.Origin).Inc()
+			q.log.Warn("pending job expired", "job", pj.Job.ID, "manager", pj.Job.Manager, "upstream", pj.Origin)
+			continue
+		}
+		pending = append(pending, pj)
+	}
+	expired := len(pending) != len(q.pending)
+	q.pending = pending
+	return expired
+}
+
+// save writes the pending jobs to the queue file, the caller must hold the
+// lock.
+func (q *jobQueue) save() {
+	if q.path == "" {
+		return
+	}
+	if err := writeFileAtomic(q.path, q.pending); err != nil {
+		q.log.Error("failed to save pending jobs", "path", q.path, "error", err)
+	}
+}
+
+// origin returns the upstream that issued a job.
+func (q *jobQueue) origin(id string) (string, bool) {
+	return q.origins.get(id)
+}
+
+// done forgets a finished job.
+func (q *jobQueue) done(id string) {
+	q.origins.delete(id)
+}
+
+// acceptsJob returns if any of the polling managers can run a job.
+func acceptsJob(managers map[string]dashapi.ManagerJobs, job *dashapi.JobPollResp) bool {
+	mgr, ok := managers[job.Manager]
+	if !ok {
+		return false
+	}
+	switch job.Type {
+	case dashapi.JobTestPatch:
+		return mgr.TestPatches
+	case dashapi.JobBisectCause:
+		return mgr.BisectCause
+	case dashapi.JobBisectFix:
+		return mgr.BisectFix
+	}
+	return false
+}
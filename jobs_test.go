@@ -0,0 +1,163 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestJobQueue(t *testing.T, order ...string) *jobQueue {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m, err := newMetrics(MetricsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	origins, err := newRouteStore("", time.Hour, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := newJobQueue(JobsConfig{PendingTTL: time.Hour}, "", order, origins, log, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestJobQueueTake(t *testing.T) {
+	q := newTestJobQueue(t, "a", "b")
+	q.add("a", &dashapi.JobPollResp{ID: "a1", Manager: "m", Type: dashapi.JobTestPatch})
+	q.add("a", &dashapi.JobPollResp{ID: "a2", Manager: "m", Type: dashapi.JobTestPatch})
+	q.add("b", &dashapi.JobPollResp{ID: "b1", Manager: "m", Type: dashapi.JobTestPatch})
+	managers := map[string]dashapi.ManagerJobs{"m": {TestPatches: true}}
+
+	// Upstreams take turns, an upstream without jobs is skipped.
+	for _, want := range []string{"a1", "b1", "a2", ""} {
+		job, origin := q.take(managers)
+		if want == "" {
+			if job != nil {
+				t.Fatalf("got job %v, want none", job.ID)
+			}
+			continue
+		}
+		if job == nil || job.ID != want {
+			t.Fatalf("got job %v, want %v", job, want)
+		}
+		if got, ok := q.origin(want); !ok || got != origin || origin != want[:1] {
+			t.Errorf("job %v: got origin %q, want %q", want, got, want[:1])
+		}
+	}
+}
+
+func TestJobQueueAccepts(t *testing.T) {
+	q := newTestJobQueue(t, "a")
+	q.add("a", &dashapi.JobPollResp{ID: "bisect", Manager: "m", Type: dashapi.JobBisectCause})
+	q.add("a", &dashapi.JobPollResp{ID: "other", Manager: "n", Type: dashapi.JobTestPatch})
+	q.add("a", &dashapi.JobPollResp{ID: "patch", Manager: "m", Type: dashapi.JobTestPatch})
+
+	for _, test := range []struct {
+		managers map[string]dashapi.ManagerJobs
+		want     string
+	}{
+		{map[string]dashapi.ManagerJobs{"x": {TestPatches: true, BisectCause: true}}, ""},
+		{map[string]dashapi.ManagerJobs{"m": {TestPatches: true}}, "patch"},
+		{map[string]dashapi.ManagerJobs{"m": {BisectCause: true}}, "bisect"},
+		{map[string]dashapi.ManagerJobs{"m": {TestPatches: true, BisectCause: true}}, ""},
+		{map[string]dashapi.ManagerJobs{"n": {TestPatches: true}}, "other"},
+	} {
+		job, _ := q.take(test.managers)
+		got := ""
+		if job != nil {
+			got = job.ID
+		}
+		if got != test.want {
+			t.Errorf("managers %v: got job %q, want %q", test.managers, got, test.want)
+		}
+	}
+}
+
+func TestJobQueueExpire(t *testing.T) {
+	q := newTestJobQueue(t, "a")
+	q.add("a", &dashapi.JobPollResp{ID: "old", Manager: "m", Type: dashapi.JobTestPatch})
+	q.pending[0].Added = time.Now().Add(-2 * time.Hour)
+	q.add("a", &dashapi.JobPollResp{ID: "new", Manager: "m", Type: dashapi.JobTestPatch})
+
+	job, _ := q.take(map[string]dashapi.ManagerJobs{"m": {TestPatches: true}})
+	if job == nil || job.ID != "new" {
+		t.Fatalf("got job %v, want new", job)
+	}
+	if n := testutil.ToFloat64(q.metrics.jobExpiredCounters.WithLabelValues("a")); n != 1 {
+		t.Errorf("got %v expired jobs, want 1", n)
+	}
+}
+
+func TestJobDoneRouting(t *testing.T) {
+	primary, secondary := newFakeDashboard(t), newFakeDashboard(t)
+	secondary.setResponse("job_poll", `{"ID": "j1", "Manager": "m", "Type": 0}`)
+	_, client := newTestProxy(t, nil, primary, secondary)
+
+	job, err := client.JobPoll(&dashapi.JobPollReq{Managers: map[string]dashapi.ManagerJobs{"m": {TestPatches: true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != "j1" {
+		t.Fatalf("got job %q, want j1", job.ID)
+	}
+	// The job is only known to the upstream that issued it.
+	if err := client.JobDone(&dashapi.JobDoneReq{ID: "j1", Build: dashapi.Build{Manager: "m"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(primary.payloads("job_done")); n != 0 {
+		t.Errorf("primary got %v job_done calls, want 0", n)
+	}
+	if n := len(secondary.payloads("job_done")); n != 1 {
+		t.Errorf("secondary got %v job_done calls, want 1", n)
+	}
+}
+
+func TestJobDoneFallback(t *testing.T) {
+	for _, test := range []struct {
+		fallback string
+		// primary and secondary are the job_done calls the upstreams get.
+		primary   int
+		secondary int
+		err       bool
+	}{
+		{fallback: JobFallbackBroadcast, primary: 1, secondary: 1},
+		{fallback: JobFallbackPrimary, primary: 1},
+		{fallback: JobFallbackReject, err: true},
+	} {
+		t.Run(test.fallback, func(t *testing.T) {
+			primary, secondary := newFakeDashboard(t), newFakeDashboard(t)
+			_, client := newTestProxy(t, &Config{Jobs: JobsConfig{Fallback: test.fallback}}, primary, secondary)
+
+			err := client.JobDone(&dashapi.JobDoneReq{ID: "unknown", Build: dashapi.Build{Manager: "m"}})
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+			if n := len(primary.payloads("job_done")); n != test.primary {
+				t.Errorf("primary got %v job_done calls, want %v", n, test.primary)
+			}
+			if n := len(secondary.payloads("job_done")); n != test.secondary {
+				t.Errorf("secondary got %v job_done calls, want %v", n, test.secondary)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherLabelValue is the label value of the series that values over a limit
+// are folded into.
+const otherLabelValue = "other"
+
+// LabelLimits limits the labels of a metric.
+type LabelLimits struct {
+	// Allow keeps only the listed labels, Deny drops the listed labels.
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	// MaxValues caps the distinct values of a label by label name, values
+	// past the cap are counted as "other". Only counters can be capped.
+	MaxValues map[string]int `yaml:"max_values"`
+}
+
+// defaultLabelLimits are the limits of the metrics that have none
+// configured, build and job IDs would make a series per build or job.
+var defaultLabelLimits = map[string]LabelLimits{
+	"builds_total":      {Deny: []string{"id"}},
+	"job_done_total":    {Deny: []string{"id", "build_id"}},
+	"build_error_total": {Deny: []string{"id"}},
+}
+
+// labelFilter drops the labels of a metric and caps their values.
+type labelFilter struct {
+	metric  string
+	dropped *prometheus.CounterVec
+	// names are the kept labels and keep their indexes in the labels of
+	// the metric.
+	names []string
+	keep  []int
+	// max is the cap on the values of every kept label, 0 if none.
+	max []int
+
+	mu sync.Mutex
+	// series are the kept series and values the number of series per
+	// value of every kept label.
+	series map[string]bool
+	values []map[string]int
+}
+
+func newLabelFilter(metric string, labels []string, limits LabelLimits, dropped *prometheus.CounterVec) (*labelFilter, error) {
+	if len(limits.Allow) != 0 && len(limits.Deny) != 0 {
+		return nil, fmt.Errorf("labels of %s: allow and deny are exclusive", metric)
+	}
+	known := map[string]bool{}
+	for _, l := range labels {
+		known[l] = true
+	}
+	listed := map[string]bool{}
+	for _, l := range append(limits.Allow, limits.Deny...) {
+		if !known[l] {
+			return nil, fmt.Errorf("labels of %s: unknown label %q", metric, l)
+		}
+		listed[l] = true
+	}
+	f := &labelFilter{
+		metric:  metric,
+		dropped: dropped,
+		series:  map[string]bool{},
+	}
+	for i, l := range labels {
+		if len(limits.Allow) != 0 && !listed[l] || len(limits.Deny) != 0 && listed[l] {
+			continue
+		}
+		f.names = append(f.names, l)
+		f.keep = append(f.keep, i)
+		f.max = append(f.max, limits.MaxValues[l])
+		f.values = append(f.values, map[string]int{})
+	}
+	for l, max := range limits.MaxValues {
+		if !known[l] {
+			return nil, fmt.Errorf("labels of %s: unknown label %q", metric, l)
+		}
+		if max < 0 {
+			return nil, fmt.Errorf("labels of %s: negative max_values for %q", metric, l)
+		}
+	}
+	return f, nil
+}
+
+// apply returns the kept label values of a series, values past their cap
+// are replaced by "other".
+func (f *labelFilter) apply(lvs []string) []string {
+	kept := make([]string, len(f.keep))
+	for i, j := range f.keep {
+		if j < len(lvs) {
+			kept[i] = lvs[j]
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.track(kept)
+}
+
+// applyLabels is apply for the kept labels by name.
+func (f *labelFilter) applyLabels(labels prometheus.Labels) ([]string, error) {
+	if len(labels) != len(f.names) {
+		return nil, fmt.Errorf("%s: got %d labels, want %d", f.metric, len(labels), len(f.names))
+	}
+	kept := make([]string, len(f.names))
+	for i, l := range f.names {
+		v, ok := labels[l]
+		if !ok {
+			return nil, fmt.Errorf("%s: missing label %q", f.metric, l)
+		}
+		kept[i] = v
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.track(kept), nil
+}
+
+// track caps the kept label values of a series and records it, the caller
+// must hold the lock.
+func (f *labelFilter) track(kept []string) []string {
+	for i, v := range kept {
+		if f.max[i] == 0 || v == otherLabelValue || f.values[i][v] != 0 || len(f.values[i]) < f.max[i] {
+			continue
+		}
+		kept[i] = otherLabelValue
+		f.dropped.WithLabelValues(f.metric, f.names[i]).Inc()
+	}
+	key := strings.Join(kept, "\xff")
+	if !f.series[key] {
+		f.series[key] = true
+		for i, v := range kept {
+			// The other series does not take up a value.
+			if f.max[i] == 0 || v != otherLabelValue {
+				f.values[i][v]++
+			}
+		}
+	}
+	return kept
+}
+
+// remove returns the kept label values of a series and forgets it, it
+// fails for series folded into "other".
+func (f *labelFilter) remove(lvs []string) ([]string, bool) {
+	kept := make([]string, len(f.keep))
+	for i, j := range f.keep {
+		if j < len(lvs) {
+			kept[i] = lvs[j]
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, v := range kept {
+		if f.max[i] != 0 && f.values[i][v] == 0 {
+			return nil, false
+		}
+	}
+	key := strings.Join(kept, "\xff")
+	if f.series[key] {
+		delete(f.series, key)
+		for i, v := range kept {
+			if f.values[i][v]--; f.values[i][v] <= 0 {
+				delete(f.values[i], v)
+			}
+		}
+	}
+	return kept, true
+}
+
+// capped returns whether the filter caps the values of any label.
+func (f *labelFilter) capped() bool {
+	for _, max := range f.max {
+		if max != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *labelFilter) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.series = map[string]bool{}
+	for i := range f.values {
+		f.values[i] = map[string]int{}
+	}
+}
+
+// counterVec is a counter vector whose labels are filtered, the filter is
+// nil for metrics without limits.
+type counterVec struct {
+	vec    *prometheus.CounterVec
+	filter *labelFilter
+}
+
+// Describe implements the prometheus.Collector interface.
+func (v *counterVec) Describe(ch chan<- *prometheus.Desc) { v.vec.Describe(ch) }
+
+// Collect implements the prometheus.Collector interface.
+func (v *counterVec) Collect(ch chan<- prometheus.Metric) { v.vec.Collect(ch) }
+
+func (v *counterVec) WithLabelValues(lvs ...string) prometheus.Counter {
+	if v.filter == nil {
+		return v.vec.WithLabelValues(lvs...)
+	}
+	return v.vec.WithLabelValues(v.filter.apply(lvs)...)
+}
+
+// GetMetricWith returns the counter of the kept labels.
+func (v *counterVec) GetMetricWith(labels prometheus.Labels) (prometheus.Counter, error) {
+	if v.filter == nil {
+		return v.vec.GetMetricWith(labels)
+	}
+	lvs, err := v.filter.applyLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+	return v.vec.GetMetricWithLabelValues(lvs...)
+}
+
+func (v *counterVec) DeleteLabelValues(lvs ...string) bool {
+	if v.filter == nil {
+		return v.vec.DeleteLabelValues(lvs...)
+	}
+	kept, ok := v.filter.remove(lvs)
+	return ok && v.vec.DeleteLabelValues(kept...)
+}
+
+func (v *counterVec) Reset() {
+	if v.filter != nil {
+		v.filter.reset()
+	}
+	v.vec.Reset()
+}
+
+// gaugeVec is a gauge vector whose labels are filtered, the filter is nil
+// for metrics without limits.
+type gaugeVec struct {
+	vec    *prometheus.GaugeVec
+	filter *labelFilter
+
+	mu sync.Mutex
+	// replaced are the label values of the series of the last replace by
+	// their key.
+	replaced map[string][]string
+}
+
+// gaugeSeries is the value of a gauge series.
+type gaugeSeries struct {
+	labels []string
+	value  float64
+}
+
+// Describe implements the prometheus.Collector interface.
+func (v *gaugeVec) Describe(ch chan<- *prometheus.Desc) { v.vec.Describe(ch) }
+
+// Collect implements the prometheus.Collector interface.
+func (v *gaugeVec) Collect(ch chan<- prometheus.Metric) { v.vec.Collect(ch) }
+
+func (v *gaugeVec) WithLabelValues(lvs ...string) prometheus.Gauge {
+	if v.filter == nil {
+		return v.vec.WithLabelValues(lvs...)
+	}
+	return v.vec.WithLabelValues(v.filter.apply(lvs)...)
+}
+
+// GetMetricWith returns the gauge of the kept labels.
+func (v *gaugeVec) GetMetricWith(labels prometheus.Labels) (prometheus.Gauge, error) {
+	if v.filter == nil {
+		return v.vec.GetMetricWith(labels)
+	}
+	lvs, err := v.filter.applyLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+	return v.vec.GetMetricWithLabelValues(lvs...)
+}
+
+func (v *gaugeVec) DeleteLabelValues(lvs ...string) bool {
+	if v.filter == nil {
+		return v.vec.DeleteLabelValues(lvs...)
+	}
+	kept, ok := v.filter.remove(lvs)
+	return ok && v.vec.DeleteLabelValues(kept...)
+}
+
+// replace sets the gauges of series and deletes the ones the last replace
+// set that are not among them. Unlike a Reset before setting them, the
+// series that stay are never missing from a scrape.
+func (v *gaugeVec) replace(series []gaugeSeries) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	replaced := map[string][]string{}
+	for _, s := range series {
+		v.WithLabelValues(s.labels...).Set(s.value)
+		replaced[strings.Join(s.labels, "\xff")] = s.labels
+	}
+	for key, lvs := range v.replaced {
+		if _, ok := replaced[key]; !ok {
+			v.DeleteLabelValues(lvs...)
+		}
+	}
+	v.replaced = replaced
+}
+
+func (v *gaugeVec) Reset() {
+	if v.filter != nil {
+		v.filter.reset()
+	}
+	v.vec.Reset()
+}
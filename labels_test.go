@@ -0,0 +1,195 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// collectSeries returns the value of every series of a collector by its
+// labels, e.g. "manager=m1,os=linux".
+func collectSeries(t *testing.T, c prometheus.Collector) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	series := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		var labels []string
+		for _, l := range pb.Label {
+			labels = append(labels, l.GetName()+"="+l.GetValue())
+		}
+		series[strings.Join(labels, ",")] = pb.GetCounter().GetValue()
+	}
+	return series
+}
+
+func TestLabelLimits(t *testing.T) {
+	// op increments the builds_total series of a build, or deletes it.
+	type op struct {
+		del     bool
+		manager string
+		id      string
+	}
+	for _, test := range []struct {
+		name    string
+		limits  LabelLimits
+		ops     []op
+		want    map[string]float64
+		dropped float64
+	}{
+		{
+			name:   "allow",
+			limits: LabelLimits{Allow: []string{"manager", "os"}},
+			ops:    []op{{manager: "m1", id: "b1"}, {manager: "m1", id: "b2"}},
+			want:   map[string]float64{"manager=m1,os=linux": 2},
+		},
+		{
+			name:   "deny",
+			limits: LabelLimits{Deny: []string{"id"}},
+			ops:    []op{{manager: "m1", id: "b1"}, {manager: "m1", id: "b2"}},
+			want:   map[string]float64{"arch=amd64,manager=m1,os=linux,vmarch=amd64": 2},
+		},
+		{
+			name: "cap",
+			limits: LabelLimits{
+				Allow:     []string{"manager"},
+				MaxValues: map[string]int{"manager": 2},
+			},
+			ops: []op{
+				{manager: "m1"}, {manager: "m2"}, {manager: "m3"}, {manager: "m4"}, {manager: "m1"},
+			},
+			want: map[string]float64{
+				"manager=m1":    2,
+				"manager=m2":    1,
+				"manager=other": 2,
+			},
+			dropped: 2,
+		},
+		{
+			name: "remove then reuse",
+			limits: LabelLimits{
+				Allow:     []string{"manager"},
+				MaxValues: map[string]int{"manager": 1},
+			},
+			ops:  []op{{manager: "m1"}, {del: true, manager: "m1"}, {manager: "m2"}},
+			want: map[string]float64{"manager=m2": 1},
+		},
+		{
+			name: "remove other",
+			limits: LabelLimits{
+				Allow:     []string{"manager"},
+				MaxValues: map[string]int{"manager": 1},
+			},
+			ops: []op{{manager: "m1"}, {manager: "m2"}, {del: true, manager: "m2"}, {manager: "m3"}},
+			want: map[string]float64{
+				"manager=m1":    1,
+				"manager=other": 2,
+			},
+			dropped: 2,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := newMetrics(MetricsConfig{
+				Labels: map[string]LabelLimits{"builds_total": test.limits},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range test.ops {
+				lvs := []string{op.manager, op.id, "linux", "amd64", "amd64"}
+				if op.del {
+					m.buildCounters.DeleteLabelValues(lvs...)
+					continue
+				}
+				m.buildCounters.WithLabelValues(lvs...).Inc()
+			}
+			if got := collectSeries(t, m.buildCounters); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got series %v, want %v", got, test.want)
+			}
+			dropped := testutil.ToFloat64(m.droppedLabelCounters.WithLabelValues("builds_total", "manager"))
+			if dropped != test.dropped {
+				t.Errorf("got %v dropped values, want %v", dropped, test.dropped)
+			}
+		})
+	}
+}
+
+func TestLabelLimitsErrors(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		metric string
+		limits LabelLimits
+	}{
+		{"allow and deny", "builds_total", LabelLimits{Allow: []string{"manager"}, Deny: []string{"id"}}},
+		{"unknown label", "builds_total", LabelLimits{Deny: []string{"client"}}},
+		{"unknown max_values label", "builds_total", LabelLimits{MaxValues: map[string]int{"client": 1}}},
+		{"negative max_values", "builds_total", LabelLimits{MaxValues: map[string]int{"manager": -1}}},
+		{"max_values on a gauge", "manager_up", LabelLimits{MaxValues: map[string]int{"manager": 1}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newMetrics(MetricsConfig{
+				Labels: map[string]LabelLimits{test.metric: test.limits},
+			}); err == nil {
+				t.Fatal("invalid limits accepted")
+			}
+		})
+	}
+}
+
+func TestDefaultLabelLimits(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		labels map[string]LabelLimits
+		want   map[string]float64
+	}{
+		{
+			name: "default",
+			want: map[string]float64{"arch=amd64,manager=m1,os=linux,vmarch=amd64": 2},
+		},
+		{
+			name:   "configured",
+			labels: map[string]LabelLimits{"builds_total": {}},
+			want: map[string]float64{
+				"arch=amd64,id=b1,manager=m1,os=linux,vmarch=amd64": 1,
+				"arch=amd64,id=b2,manager=m1,os=linux,vmarch=amd64": 1,
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := newMetrics(MetricsConfig{Labels: test.labels})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"b1", "b2"} {
+				m.buildCounters.WithLabelValues("m1", id, "linux", "amd64", "amd64").Inc()
+			}
+			if got := collectSeries(t, m.buildCounters); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got series %v, want %v", got, test.want)
+			}
+		})
+	}
+}
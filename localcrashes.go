@@ -0,0 +1,159 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+const (
+	// localCrashesSize is the number of local crashes served on
+	// /local_crashes.
+	localCrashesSize = 1000
+	// defaultLocalCrashesBytes is the size of the local crashes file by
+	// default.
+	defaultLocalCrashesBytes = 64 << 20
+)
+
+// LocalCrashesConfig configures the file local crashes are saved in.
+type LocalCrashesConfig struct {
+	// MaxBytes is the size of the file, once it is reached the file is
+	// rotated and replaces the previous one. It defaults to 64MiB.
+	MaxBytes int64 `yaml:"max_bytes"`
+}
+
+func (conf *LocalCrashesConfig) validate() error {
+	if conf.MaxBytes < 0 {
+		return fmt.Errorf("local_crashes: negative max_bytes")
+	}
+	if conf.MaxBytes == 0 {
+		conf.MaxBytes = defaultLocalCrashesBytes
+	}
+	return nil
+}
+
+// localCrash is a crash kept locally by a crash rule.
+type localCrash struct {
+	Time    time.Time `json:"time"`
+	Rule    string    `json:"rule"`
+	Manager string    `json:"manager"`
+	BuildID string    `json:"build_id"`
+	Title   string    `json:"title"`
+}
+
+// localCrashStore keeps the last local crashes in memory and appends every
+// local crash in full to a file when it has one.
+type localCrashStore struct {
+	conf LocalCrashesConfig
+	path string
+	log  *slog.Logger
+
+	mu      sync.Mutex
+	crashes []localCrash
+	next    int
+	// size is the size of the file.
+	size int64
+}
+
+func newLocalCrashStore(conf LocalCrashesConfig, path string, log *slog.Logger) *localCrashStore {
+	s := &localCrashStore{
+		conf: conf,
+		path: path,
+		log:  log,
+	}
+	if fi, err := os.Stat(path); err == nil {
+		s.size = fi.Size()
+	}
+	return s
+}
+
+// add keeps a crash, the oldest crash in memory is replaced once there are
+// localCrashesSize of them.
+func (s *localCrashStore) add(rule, manager string, crash *dashapi.Crash) {
+	lc := localCrash{
+		Time:    time.Now(),
+		Rule:    rule,
+		Manager: manager,
+		BuildID: crash.BuildID,
+		Title:   crash.Title,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.crashes) < localCrashesSize {
+		s.crashes = append(s.crashes, lc)
+	} else {
+		s.crashes[s.next] = lc
+		s.next = (s.next + 1) % localCrashesSize
+	}
+	if s.path == "" {
+		return
+	}
+	if err := s.append(lc, crash); err != nil {
+		s.log.Error("failed to save local crash", "path", s.path, "error", err)
+	}
+}
+
+// append appends a crash as a json line to the file, a full file is first
+// rotated to path.1. The caller must hold the lock.
+func (s *localCrashStore) append(lc localCrash, crash *dashapi.Crash) error {
+	b, err := json.Marshal(struct {
+		localCrash
+		Crash *dashapi.Crash `json:"crash"`
+	}{lc, crash})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if s.size > 0 && s.size+int64(len(b)) > s.conf.MaxBytes {
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return err
+		}
+		s.size = 0
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := f.Write(b)
+	s.size += int64(n)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// list returns the crashes in memory, oldest first.
+func (s *localCrashStore) list() []localCrash {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append(append([]localCrash{}, s.crashes[s.next:]...), s.crashes[:s.next]...)
+}
+
+// LocalCrashes serves the last crashes kept locally by crash rules.
+func (p *proxy) LocalCrashes(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"crashes": p.localCrashes.list(),
+	})
+}
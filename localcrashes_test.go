@@ -0,0 +1,54 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+func TestLocalCrashRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "local_crashes.jsonl")
+	s := newLocalCrashStore(LocalCrashesConfig{MaxBytes: 1}, path, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	for _, title := range []string{"c1", "c2", "c3"} {
+		s.add("rule", "m", &dashapi.Crash{BuildID: "b", Title: title, Log: []byte("log")})
+	}
+	if got := s.list(); len(got) != 3 || got[0].Title != "c1" || got[2].Title != "c3" {
+		t.Errorf("got local crashes %v, want c1, c2 and c3", got)
+	}
+	// Every crash fills the file, which is rotated before the next one.
+	for file, want := range map[string]string{path: "c3", path + ".1": "c2"} {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var crash struct {
+			Title string         `json:"title"`
+			Crash *dashapi.Crash `json:"crash"`
+		}
+		if err := json.Unmarshal(b, &crash); err != nil {
+			t.Fatalf("%v: %v", file, err)
+		}
+		if crash.Title != want || string(crash.Crash.Log) != "log" {
+			t.Errorf("%v: got crash %q with log %q, want %q", file, crash.Title, crash.Crash.Log, want)
+		}
+	}
+}
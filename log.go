@@ -0,0 +1,87 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	redacted = "REDACTED"
+
+	logContextKey   = "proxy.log"
+	requestIDHeader = "X-Request-ID"
+)
+
+// secretAttrs are attribute keys whose values are never logged.
+var secretAttrs = map[string]bool{
+	"key":           true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"authorization": true,
+}
+
+// NewLogger returns a structured logger that writes in the given format,
+// either json or logfmt, and redacts secrets.
+func NewLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{
+		Level:       lvl,
+		ReplaceAttr: redact,
+	}
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "logfmt":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if secretAttrs[strings.ToLower(a.Key)] {
+		a.Value = slog.StringValue(redacted)
+	}
+	return a
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// logger returns the request scoped logger.
+func (p *proxy) logger(c *gin.Context) *slog.Logger {
+	if log, ok := c.Get(logContextKey); ok {
+		return log.(*slog.Logger)
+	}
+	return p.log
+}
@@ -0,0 +1,97 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoggerRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := NewLogger(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Info("call", "client", "ci", "key", "k1", "Token", "t1",
+		slog.Group("upstream", "addr", "dash", "password", "p1"))
+	var got struct {
+		Client   string
+		Key      string
+		Token    string
+		Upstream struct {
+			Addr     string
+			Password string
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Client != "ci" || got.Upstream.Addr != "dash" {
+		t.Errorf("got client %q and upstream %q, want ci and dash", got.Client, got.Upstream.Addr)
+	}
+	for name, v := range map[string]string{"key": got.Key, "Token": got.Token, "password": got.Upstream.Password} {
+		if v != redacted {
+			t.Errorf("got %v %q, want it redacted", name, v)
+		}
+	}
+	if _, err := NewLogger(&buf, "xml", "info"); err == nil {
+		t.Errorf("unknown log format accepted")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var buf bytes.Buffer
+	log, err := NewLogger(&buf, "logfmt", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(nil, &Config{Logger: log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	r := gin.New()
+	r.POST("/api", p.Proxy)
+
+	for _, id := range []string{"given-id", ""} {
+		form := url.Values{"client": {"ci"}, "key": {"secret-key"}, "method": {"commit_poll"}}
+		req := httptest.NewRequest(http.MethodPost, "/api", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		buf.Reset()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		got := w.Header().Get(requestIDHeader)
+		if got == "" || id != "" && got != id {
+			t.Errorf("got request ID %q, want %q", got, id)
+		}
+		if line := buf.String(); !strings.Contains(line, "request_id="+got) || strings.Contains(line, "secret-key") {
+			t.Errorf("got log %q, want request ID %v and no key", line, got)
+		}
+	}
+}
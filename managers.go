@@ -0,0 +1,296 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+const (
+	// defaultStaleAfter is how long a manager may stay silent before it is
+	// down by default.
+	defaultStaleAfter = 30 * time.Minute
+	// defaultManagerRetention is how long a silent manager is kept by
+	// default.
+	defaultManagerRetention = 24 * time.Hour
+	// staleCheckInterval is how often managers are checked for staleness at
+	// most.
+	staleCheckInterval = 30 * time.Second
+)
+
+// ManagersConfig configures the manager registry.
+type ManagersConfig struct {
+	// StaleAfter is how long a manager may stay silent before it is down,
+	// it defaults to 30 minutes.
+	StaleAfter time.Duration `yaml:"stale_after"`
+	// Retention is how long a silent manager is kept before it and its
+	// metrics are removed, it defaults to a day.
+	Retention time.Duration `yaml:"retention"`
+	// SnapshotInterval is how often the managers and their metrics are
+	// saved in the state dir, it defaults to a minute.
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+}
+
+func (conf *ManagersConfig) validate() error {
+	if conf.StaleAfter == 0 {
+		conf.StaleAfter = defaultStaleAfter
+	}
+	if conf.Retention == 0 {
+		conf.Retention = defaultManagerRetention
+	}
+	if conf.SnapshotInterval <= 0 {
+		conf.SnapshotInterval = defaultSnapshotInterval
+	}
+	if conf.StaleAfter < 0 || conf.Retention < conf.StaleAfter {
+		return fmt.Errorf("managers: retention %v shorter than stale_after %v", conf.Retention, conf.StaleAfter)
+	}
+	return nil
+}
+
+// managerInfo is what the proxy knows about a manager.
+type managerInfo struct {
+	Name            string    `json:"name"`
+	Client          string    `json:"client"`
+	Addr            string    `json:"addr"`
+	OS              string    `json:"os"`
+	Arch            string    `json:"arch"`
+	VMArch          string    `json:"vmarch"`
+	BuildID         string    `json:"build_id"`
+	KernelCommit    string    `json:"kernel_commit"`
+	SyzkallerCommit string    `json:"syzkaller_commit"`
+	FirstSeen       time.Time `json:"first_seen"`
+	LastSeen        time.Time `json:"last_seen"`
+	// Up is false when the manager stayed silent for too long.
+	Up       bool `json:"up"`
+	Restarts int  `json:"restarts"`
+	// UpTime is the uptime of the last stats upload.
+	UpTime         time.Duration `json:"uptime"`
+	Corpus         uint64        `json:"corpus"`
+	Cover          uint64        `json:"cover"`
+	ExecsPerSecond float64       `json:"execs_per_second"`
+	// Team, Cluster and KernelTree come from the manager labels.
+	Team       string `json:"team"`
+	Cluster    string `json:"cluster"`
+	KernelTree string `json:"kernel_tree"`
+
+	// labels are the labels of the manager info metric.
+	labels []string
+}
+
+// managerRegistry records the managers seen in manager_stats, upload_build
+// and job_poll calls.
+type managerRegistry struct {
+	conf      ManagersConfig
+	labels    []*ManagerLabels
+	anomalies *anomalyDetector
+	log       *slog.Logger
+	metrics   *metrics
+
+	mu       sync.Mutex
+	managers map[string]*managerInfo
+}
+
+func newManagerRegistry(conf ManagersConfig, labels []*ManagerLabels, anomalies *anomalyDetector, log *slog.Logger, m *metrics) *managerRegistry {
+	return &managerRegistry{
+		conf:      conf,
+		labels:    labels,
+		anomalies: anomalies,
+		log:       log,
+		metrics:   m,
+		managers:  map[string]*managerInfo{},
+	}
+}
+
+// seen records a call of a manager and returns it, the caller must hold
+// the lock.
+func (r *managerRegistry) seen(name, client string) *managerInfo {
+	now := time.Now()
+	m, ok := r.managers[name]
+	if !ok {
+		m = &managerInfo{Name: name, FirstSeen: now}
+		r.enrich(m)
+		r.managers[name] = m
+	}
+	if !m.Up && ok {
+		r.log.Info("manager back up", "manager", name, "silent", now.Sub(m.LastSeen))
+	}
+	m.Client = client
+	m.LastSeen = now
+	up := m.Up
+	m.Up = true
+	if !up {
+		r.aggregate()
+	}
+	r.metrics.managerLastSeenGauges.WithLabelValues(name).Set(float64(now.Unix()))
+	r.metrics.managerUpGauges.WithLabelValues(name).Set(1)
+	return m
+}
+
+// checkInterval returns how often the managers are checked for staleness.
+func (r *managerRegistry) checkInterval() time.Duration {
+	if r.conf.StaleAfter/2 < staleCheckInterval {
+		return r.conf.StaleAfter / 2
+	}
+	return staleCheckInterval
+}
+
+// check marks the managers that stayed silent for too long as down and
+// removes the ones gone for longer than the retention along with their
+// metrics and anomalies.
+func (r *managerRegistry) check() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.aggregate()
+	defer r.anomalies.expire()
+	for name, m := range r.managers {
+		silent := time.Since(m.LastSeen)
+		switch {
+		case silent > r.conf.Retention:
+			r.log.Info("manager removed", "manager", name, "silent", silent)
+			delete(r.managers, name)
+			r.metrics.managerInfoGauges.DeleteLabelValues(m.labels...)
+			r.metrics.deleteManagerSeries(name)
+			r.anomalies.forget(name)
+		case silent > r.conf.StaleAfter && m.Up:
+			r.log.Warn("manager down", "manager", name, "silent", silent)
+			m.Up = false
+			r.metrics.managerUpGauges.WithLabelValues(name).Set(0)
+		}
+	}
+}
+
+// build records the build a manager uploaded.
+func (r *managerRegistry) build(client string, build *dashapi.Build) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := r.seen(build.Manager, client)
+	m.OS, m.Arch, m.VMArch = build.OS, build.Arch, build.VMArch
+	m.BuildID = build.ID
+	m.KernelCommit = build.KernelCommit
+	m.SyzkallerCommit = build.SyzkallerCommit
+	r.update(m)
+}
+
+// stats records a manager that uploaded stats and returns whether they
+// repeat the last accepted upload.
+func (r *managerRegistry) stats(client string, req *dashapi.ManagerStatsReq) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := r.seen(req.Name, client)
+	m.Addr = req.Addr
+	r.update(m)
+	// The uptime of a running manager only goes forward, the uptime of the
+	// last accepted upload is the same upload sent again.
+	return m.UpTime != 0 && req.UpTime == m.UpTime
+}
+
+// accepted records the stats of an upload the upstreams accepted and returns
+// the time their deltas cover, which is zero when it is unknown. Managers
+// resend the deltas of failed uploads, so only accepted uploads count.
+func (r *managerRegistry) accepted(req *dashapi.ManagerStatsReq) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.managers[req.Name]
+	if !ok {
+		return 0
+	}
+	// A smaller uptime than the last accepted upload is a restart.
+	var (
+		last    = m.UpTime
+		elapsed time.Duration
+	)
+	switch {
+	case last == 0, req.UpTime == last:
+	case req.UpTime < last:
+		m.Restarts++
+		r.metrics.managerRestartCounters.WithLabelValues(req.Name).Inc()
+		r.log.Info("manager restarted", "manager", req.Name, "uptime", req.UpTime)
+		elapsed = req.UpTime
+	default:
+		elapsed = req.UpTime - last
+	}
+	m.UpTime = req.UpTime
+	m.Corpus, m.Cover = req.Corpus, req.Cover
+	if elapsed > 0 {
+		m.ExecsPerSecond = float64(req.Execs) / elapsed.Seconds()
+	}
+	r.metrics.fleetCrashesCounters.WithLabelValues(m.Team, m.Cluster, m.KernelTree).Add(float64(req.Crashes))
+	r.aggregate()
+	return elapsed
+}
+
+// poll records the managers of a job poll.
+func (r *managerRegistry) poll(client string, managers map[string]dashapi.ManagerJobs) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name := range managers {
+		r.update(r.seen(name, client))
+	}
+}
+
+// restore restores saved managers.
+func (r *managerRegistry) restore(managers []managerInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range managers {
+		m := m
+		r.enrich(&m)
+		r.managers[m.Name] = &m
+		r.update(&m)
+	}
+	r.aggregate()
+}
+
+// list returns the managers sorted by name.
+func (r *managerRegistry) list() []managerInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	managers := make([]managerInfo, 0, len(r.managers))
+	for _, m := range r.managers {
+		managers = append(managers, *m)
+	}
+	sort.Slice(managers, func(i, j int) bool {
+		return managers[i].Name < managers[j].Name
+	})
+	return managers
+}
+
+// update updates the manager info metric, the series of the previous
+// labels is removed.
+func (r *managerRegistry) update(m *managerInfo) {
+	labels := []string{
+		m.Name, m.Client, m.Addr, m.OS, m.Arch, m.VMArch,
+		m.BuildID, m.KernelCommit, m.SyzkallerCommit,
+		m.Team, m.Cluster, m.KernelTree,
+	}
+	if m.labels != nil {
+		r.metrics.managerInfoGauges.DeleteLabelValues(m.labels...)
+	}
+	r.metrics.managerInfoGauges.WithLabelValues(labels...).Set(1)
+	m.labels = labels
+}
+
+// Managers returns the managers the proxy has seen.
+func (p *proxy) Managers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"managers": p.managers.list()})
+}
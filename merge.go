@@ -0,0 +1,121 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import "github.com/google/syzkaller/dashboard/dashapi"
+
+// mergeBuilderPoll merges the builder_poll responses of upstreams, pending
+// commits are de-duplicated and the report email is the one of the first
+// upstream in order that has one as syz-ci only takes a single email.
+func (p *proxy) mergeBuilderPoll(resps map[string]*dashapi.BuilderPollResp) *dashapi.BuilderPollResp {
+	var (
+		merged = &dashapi.BuilderPollResp{}
+		seen   = map[string]bool{}
+	)
+	for _, addr := range p.order {
+		resp, ok := resps[addr]
+		if !ok {
+			continue
+		}
+		for _, commit := range resp.PendingCommits {
+			if seen[commit] {
+				continue
+			}
+			seen[commit] = true
+			merged.PendingCommits = append(merged.PendingCommits, commit)
+		}
+		if merged.ReportEmail == "" {
+			merged.ReportEmail = resp.ReportEmail
+		}
+	}
+	return merged
+}
+
+// originBugReport is a bug report tagged with the upstream that produced it,
+// clients that do not know the tag ignore it.
+type originBugReport struct {
+	*dashapi.BugReport
+	Origin string
+}
+
+// mergePollBugs merges the reporting_poll_bugs responses of upstreams and
+// remembers the upstream of every bug. A bug ID that several upstreams report
+// is kept for the first upstream in order as updates can only go to one.
+func (p *proxy) mergePollBugs(resps map[string]*dashapi.PollBugsResponse) []originBugReport {
+	var (
+		reports = []originBugReport{}
+		origins = map[string]string{}
+	)
+	for _, addr := range p.order {
+		resp, ok := resps[addr]
+		if !ok {
+			continue
+		}
+		for _, report := range resp.Reports {
+			if origin, ok := origins[report.ID]; ok && origin != addr {
+				p.log.Warn("bug reported by several upstreams",
+					"bug", report.ID, "upstream", addr, "origin", origin)
+				continue
+			}
+			origins[report.ID] = addr
+			reports = append(reports, originBugReport{report, addr})
+		}
+	}
+	p.bugOrigins.setAll(origins)
+	return reports
+}
+
+// mergeUpdateReplies returns the reply of the first upstream in order that
+// accepted a bug update, or else the first reply.
+func (p *proxy) mergeUpdateReplies(replies map[string]*dashapi.BugUpdateReply) *dashapi.BugUpdateReply {
+	var first *dashapi.BugUpdateReply
+	for _, addr := range p.order {
+		reply, ok := replies[addr]
+		if !ok {
+			continue
+		}
+		if reply.OK {
+			return reply
+		}
+		if first == nil {
+			first = reply
+		}
+	}
+	return first
+}
+
+// mergeBugList merges the bug_list responses of upstreams into the
+// de-duplicated list of bug IDs and remembers the upstream of every bug.
+func (p *proxy) mergeBugList(resps map[string]*dashapi.BugListResp) *dashapi.BugListResp {
+	var (
+		merged  = &dashapi.BugListResp{}
+		origins = map[string]string{}
+	)
+	for _, addr := range p.order {
+		resp, ok := resps[addr]
+		if !ok {
+			continue
+		}
+		for _, id := range resp.List {
+			if _, ok := origins[id]; ok {
+				continue
+			}
+			origins[id] = addr
+			merged.List = append(merged.List, id)
+		}
+	}
+	p.bugOrigins.setAll(origins)
+	return merged
+}
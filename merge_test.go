@@ -0,0 +1,86 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+func newTestMergeProxy(t *testing.T, order ...string) *proxy {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	bugOrigins, err := newRouteStore("", time.Hour, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &proxy{
+		order:      order,
+		log:        log,
+		bugOrigins: bugOrigins,
+	}
+}
+
+func TestMergePollBugs(t *testing.T) {
+	p := newTestMergeProxy(t, "a", "b", "c")
+	reports := func(ids ...string) *dashapi.PollBugsResponse {
+		resp := &dashapi.PollBugsResponse{}
+		for _, id := range ids {
+			resp.Reports = append(resp.Reports, &dashapi.BugReport{ID: id})
+		}
+		return resp
+	}
+	merged := p.mergePollBugs(map[string]*dashapi.PollBugsResponse{
+		"b": reports("b1", "x"),
+		"a": reports("a1", "x"),
+	})
+
+	var got [][2]string
+	for _, r := range merged {
+		got = append(got, [2]string{r.ID, r.Origin})
+	}
+	// Reports come in upstream order and a bug reported by several
+	// upstreams belongs to the first one.
+	want := [][2]string{{"a1", "a"}, {"x", "a"}, {"b1", "b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got reports %v, want %v", got, want)
+	}
+	for _, r := range want {
+		if origin, ok := p.bugOrigins.get(r[0]); !ok || origin != r[1] {
+			t.Errorf("bug %v: got origin %q, want %q", r[0], origin, r[1])
+		}
+	}
+}
+
+func TestMergeBugList(t *testing.T) {
+	p := newTestMergeProxy(t, "a", "b")
+	merged := p.mergeBugList(map[string]*dashapi.BugListResp{
+		"a": {List: []string{"a1", "x"}},
+		"b": {List: []string{"x", "b1", "b1"}},
+	})
+
+	if want := []string{"a1", "x", "b1"}; !reflect.DeepEqual(merged.List, want) {
+		t.Errorf("got bugs %v, want %v", merged.List, want)
+	}
+	for id, want := range map[string]string{"a1": "a", "x": "a", "b1": "b"} {
+		if origin, ok := p.bugOrigins.get(id); !ok || origin != want {
+			t.Errorf("bug %v: got origin %q, want %q", id, origin, want)
+		}
+	}
+}
@@ -14,133 +14,583 @@
 
 package proxy
 
-import "github.com/prometheus/client_golang/prometheus"
-
-var (
-	rpcCounters = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "requests_total",
-			Help: "Number of requests.",
-		},
-		[]string{"client", "method"},
-	)
-)
+import (
+	"fmt"
 
-// dashapi.Build metrics
-var (
-	buildCounters = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "builds_total",
-			Help: "Number of builds.",
-		},
-		[]string{"manager", "id", "os", "arch", "vmarch"},
-	)
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// dashapi.JobPollReq metrics
-var (
-	jobPollCounters = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "job_poll_total",
-			Help: "Number of job polls.",
-		},
-		[]string{"manager"},
-	)
-)
+// MetricsConfig configures the names of the proxy metrics.
+type MetricsConfig struct {
+	// Namespace and Subsystem prefix the metric names, requests_total is
+	// served as <namespace>_<subsystem>_requests_total.
+	Namespace string `yaml:"namespace"`
+	Subsystem string `yaml:"subsystem"`
+	// Labels limits the labels of metrics by their unprefixed name.
+	Labels map[string]LabelLimits `yaml:"labels"`
+}
 
-// dashapi.JobDoneReq metrics
-var (
-	jobDoneCounters = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "job_done_total",
-			Help: "Number of jobs completed.",
-		},
-		[]string{"id", "manager", "build_id", "os", "arch", "vmarch"},
-	)
-)
+// metrics are the metrics of a proxy.
+type metrics struct {
+	rpcCounters                   *counterVec
+	throttledCounters             *counterVec
+	writeCounters                 *counterVec
+	writeOutcomeCounters          *counterVec
+	offlineGauge                  prometheus.Gauge
+	offlineReadCounters           *counterVec
+	offlineWriteCounters          *counterVec
+	offlineQueueGauges            *gaugeVec
+	cacheCounters                 *counterVec
+	cacheEntriesGauges            *gaugeVec
+	coalescedCounters             *counterVec
+	cacheInvalidationCounters     *counterVec
+	buildCounters                 *counterVec
+	jobPollCounters               *counterVec
+	jobCounters                   *counterVec
+	jobExpiredCounters            *counterVec
+	jobDoneCounters               *counterVec
+	buildErrorCounters            *counterVec
+	crashRuleCounters             *counterVec
+	reproVoteCounters             *counterVec
+	reproBudgetAttemptsGauges     *gaugeVec
+	reproBudgetDeniedCounters     *counterVec
+	managerLastSeenGauges         *gaugeVec
+	managerUpGauges               *gaugeVec
+	managerRestartCounters        *counterVec
+	managerDuplicateStatsCounters *counterVec
+	managerExecRateGauges         *gaugeVec
+	managerCrashRateGauges        *gaugeVec
+	managerAnomalyGauges          *gaugeVec
+	managerAnomalyCounters        *counterVec
+	managerInfoGauges             *gaugeVec
+	managerUptimeGauges           *gaugeVec
+	managerCorpusGauges           *gaugeVec
+	managerPCsGauges              *gaugeVec
+	managerCoverageGauges         *gaugeVec
+	managerCrashesCounters        *counterVec
+	managerSuppCrashesCounters    *counterVec
+	managerExecsCounters          *counterVec
+	managerFuzzingDurCounters     *counterVec
+	fleetManagersGauges           *gaugeVec
+	fleetCorpusGauges             *gaugeVec
+	fleetCoverageGauges           *gaugeVec
+	fleetExecRateGauges           *gaugeVec
+	fleetCrashesCounters          *counterVec
+	droppedLabelCounters          *prometheus.CounterVec
+}
 
-// dashapi.BuildErrorReq metrics
-var (
-	buildErrorCounters = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "build_error_total",
-			Help: "Number of job build errors.",
-		},
-		[]string{"manager", "id", "os", "arch", "vmarch"},
-	)
-)
+// metricsBuilder names the metrics of a proxy and applies their label
+// limits.
+type metricsBuilder struct {
+	conf    MetricsConfig
+	dropped *prometheus.CounterVec
+	names   map[string]bool
+	err     error
+}
 
-// dashapi.ManagerStatsReq metrics
-var (
-	managerUptimeGauges = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "manager_uptime_total",
-			Help: "Manager uptime.",
-		},
-		[]string{"manager"},
-	)
-	managerCorpusGauges = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "manager_corpus_total",
-			Help: "Manager corpus total.",
-		},
-		[]string{"manager"},
-	)
-	managerPCsGauges = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "manager_pcs_total",
-			Help: "Manager pcs total.",
-		},
-		[]string{"manager"},
-	)
-	managerCoverageGauges = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "manager_coverage_total",
-			Help: "Manager coverage total.",
-		},
-		[]string{"manager"},
-	)
-	managerCrashesCounters = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "manager_crashes_total",
-			Help: "Manager crashes total.",
-		},
-		[]string{"manager"},
-	)
-	managerSuppCrashesCounters = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "manager_supp_crashes_total",
-			Help: "Manager suppressed crashes total.",
-		},
-		[]string{"manager"},
-	)
-	managerExecsCounters = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "manager_execs_total",
-			Help: "Manager execs total.",
-		},
-		[]string{"manager"},
-	)
-	managerFuzzingDurCounters = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "manager_fuzzing_dur_total",
-			Help: "Manager fuzzing duration total.",
-		},
-		[]string{"manager"},
-	)
-)
+// filter returns the label filter and the kept labels of a metric.
+func (b *metricsBuilder) filter(name string, labels []string) (*labelFilter, []string) {
+	b.names[name] = true
+	limits, ok := b.conf.Labels[name]
+	if !ok {
+		limits, ok = defaultLabelLimits[name]
+	}
+	if !ok {
+		return nil, labels
+	}
+	f, err := newLabelFilter(name, labels, limits, b.dropped)
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+		return nil, labels
+	}
+	return f, f.names
+}
+
+func (b *metricsBuilder) counterVec(opts prometheus.CounterOpts, labels []string) *counterVec {
+	opts.Namespace, opts.Subsystem = b.conf.Namespace, b.conf.Subsystem
+	f, labels := b.filter(opts.Name, labels)
+	return &counterVec{vec: prometheus.NewCounterVec(opts, labels), filter: f}
+}
+
+func (b *metricsBuilder) gaugeVec(opts prometheus.GaugeOpts, labels []string) *gaugeVec {
+	opts.Namespace, opts.Subsystem = b.conf.Namespace, b.conf.Subsystem
+	f, labels := b.filter(opts.Name, labels)
+	if f != nil && f.capped() && b.err == nil {
+		// The gauges of the series folded into other would overwrite each
+		// other.
+		b.err = fmt.Errorf("labels of %s: max_values is not supported on gauges", opts.Name)
+	}
+	return &gaugeVec{vec: prometheus.NewGaugeVec(opts, labels), filter: f}
+}
+
+func (b *metricsBuilder) gauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	opts.Namespace, opts.Subsystem = b.conf.Namespace, b.conf.Subsystem
+	b.names[opts.Name] = true
+	return prometheus.NewGauge(opts)
+}
+
+// newMetrics returns the metrics of a proxy named in the configured namespace
+// and subsystem.
+func newMetrics(conf MetricsConfig) (*metrics, error) {
+	b := &metricsBuilder{
+		conf: conf,
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: conf.Namespace,
+				Subsystem: conf.Subsystem,
+				Name:      "label_values_dropped_total",
+				Help:      "Number of label values counted as other because of label limits.",
+			},
+			[]string{"metric", "label"},
+		),
+		names: map[string]bool{},
+	}
+	m := &metrics{
+		rpcCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "requests_total",
+				Help: "Number of requests.",
+			},
+			[]string{"client", "method"},
+		),
+		throttledCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "throttled_requests_total",
+				Help: "Number of requests rejected by rate limits.",
+			},
+			[]string{"client", "manager", "method"},
+		),
+		writeCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "upstream_writes_total",
+				Help: "Number of writes by upstream and result.",
+			},
+			[]string{"method", "upstream", "result"},
+		),
+		writeOutcomeCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "write_outcomes_total",
+				Help: "Number of mirrored writes by write policy and outcome.",
+			},
+			[]string{"method", "policy", "ok"},
+		),
+		offlineGauge: b.gauge(
+			prometheus.GaugeOpts{
+				Name: "offline",
+				Help: "Whether every upstream is unreachable.",
+			},
+		),
+		offlineReadCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "offline_reads_total",
+				Help: "Number of reads answered with offline defaults.",
+			},
+			[]string{"method"},
+		),
+		offlineWriteCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "offline_writes_total",
+				Help: "Number of writes queued, redelivered, rejected or dropped while offline.",
+			},
+			[]string{"method", "upstream", "result"},
+		),
+		offlineQueueGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "offline_queue_length",
+				Help: "Number of queued writes by upstream.",
+			},
+			[]string{"upstream"},
+		),
+		cacheCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "cache_requests_total",
+				Help: "Number of cache lookups by result.",
+			},
+			[]string{"method", "result"},
+		),
+		cacheEntriesGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "cache_entries",
+				Help: "Number of cached responses.",
+			},
+			[]string{"method"},
+		),
+		coalescedCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "coalesced_requests_total",
+				Help: "Number of requests that shared the upstream calls of an identical request.",
+			},
+			[]string{"method"},
+		),
+		cacheInvalidationCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "cache_invalidations_total",
+				Help: "Number of cache invalidations by write.",
+			},
+			[]string{"method", "write"},
+		),
+
+		// dashapi.Build metrics
+		buildCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "builds_total",
+				Help: "Number of builds.",
+			},
+			[]string{"manager", "id", "os", "arch", "vmarch"},
+		),
+
+		// dashapi.JobPollReq metrics
+		jobPollCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "job_poll_total",
+				Help: "Number of job polls.",
+			},
+			[]string{"manager"},
+		),
+		jobCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "jobs_total",
+				Help: "Number of jobs handed out to managers.",
+			},
+			[]string{"upstream"},
+		),
+		jobExpiredCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "jobs_expired_total",
+				Help: "Number of polled jobs dropped without being handed out.",
+			},
+			[]string{"upstream"},
+		),
+
+		// dashapi.JobDoneReq metrics
+		jobDoneCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "job_done_total",
+				Help: "Number of jobs completed.",
+			},
+			[]string{"id", "manager", "build_id", "os", "arch", "vmarch"},
+		),
+
+		// dashapi.BuildErrorReq metrics
+		buildErrorCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "build_error_total",
+				Help: "Number of job build errors.",
+			},
+			[]string{"manager", "id", "os", "arch", "vmarch"},
+		),
+
+		// dashapi.Crash metrics
+		crashRuleCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "crash_rule_hits_total",
+				Help: "Number of crashes matched by crash rules.",
+			},
+			[]string{"rule", "action"},
+		),
+
+		// dashapi.CrashID metrics
+		reproVoteCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "need_repro_votes_total",
+				Help: "Number of need_repro answers by upstream.",
+			},
+			[]string{"upstream", "need_repro"},
+		),
+		reproBudgetAttemptsGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "repro_budget_attempts",
+				Help: "Number of reproduction attempts in the budget window.",
+			},
+			[]string{"manager"},
+		),
+		reproBudgetDeniedCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "repro_budget_denied_total",
+				Help: "Number of reproductions denied by the budget.",
+			},
+			[]string{"manager"},
+		),
+
+		// dashapi.ManagerStatsReq metrics
+		managerLastSeenGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "manager_last_seen_timestamp_seconds",
+				Help: "Time a manager was last seen.",
+			},
+			[]string{"manager"},
+		),
+		managerUpGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "manager_up",
+				Help: "Whether a manager was seen recently.",
+			},
+			[]string{"manager"},
+		),
+		managerRestartCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "manager_restarts_total",
+				Help: "Number of manager restarts seen in manager stats.",
+			},
+			[]string{"manager"},
+		),
+		managerDuplicateStatsCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "manager_stats_duplicates_total",
+				Help: "Number of ignored duplicate manager stats.",
+			},
+			[]string{"manager"},
+		),
+		managerExecRateGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "manager_execs_per_second",
+				Help: "Manager execs per second since the last stats.",
+			},
+			[]string{"manager"},
+		),
+		managerCrashRateGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "manager_crashes_per_hour",
+				Help: "Manager crashes per hour since the last stats.",
+			},
+			[]string{"manager"},
+		),
+		managerAnomalyGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "manager_anomaly",
+				Help: "Whether a manager has an anomaly of a kind.",
+			},
+			[]string{"manager", "kind"},
+		),
+		managerAnomalyCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "manager_anomalies_total",
+				Help: "Number of anomalies found by manager and kind.",
+			},
+			[]string{"manager", "kind"},
+		),
+		managerInfoGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "manager_info",
+				Help: "Manager information, always 1.",
+			},
+			[]string{
+				"manager", "client", "addr", "os", "arch", "vmarch",
+				"build_id", "kernel_commit", "syzkaller_commit",
+				"team", "cluster", "kernel_tree",
+			},
+		),
+		managerUptimeGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "manager_uptime_total",
+				Help: "Manager uptime.",
+			},
+			[]string{"manager"},
+		),
+		managerCorpusGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "manager_corpus_total",
+				Help: "Manager corpus total.",
+			},
+			[]string{"manager"},
+		),
+		managerPCsGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "manager_pcs_total",
+				Help: "Manager pcs total.",
+			},
+			[]string{"manager"},
+		),
+		managerCoverageGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "manager_coverage_total",
+				Help: "Manager coverage total.",
+			},
+			[]string{"manager"},
+		),
+		managerCrashesCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "manager_crashes_total",
+				Help: "Manager crashes total.",
+			},
+			[]string{"manager"},
+		),
+		managerSuppCrashesCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "manager_supp_crashes_total",
+				Help: "Manager suppressed crashes total.",
+			},
+			[]string{"manager"},
+		),
+		managerExecsCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "manager_execs_total",
+				Help: "Manager execs total.",
+			},
+			[]string{"manager"},
+		),
+		managerFuzzingDurCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "manager_fuzzing_dur_total",
+				Help: "Manager fuzzing duration total.",
+			},
+			[]string{"manager"},
+		),
+
+		// Fleet metrics aggregate the managers that are up by their labels.
+		fleetManagersGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "fleet_managers",
+				Help: "Number of managers that are up.",
+			},
+			[]string{"team", "cluster", "kernel_tree"},
+		),
+		fleetCorpusGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "fleet_corpus",
+				Help: "Fleet corpus total.",
+			},
+			[]string{"team", "cluster", "kernel_tree"},
+		),
+		fleetCoverageGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "fleet_coverage",
+				Help: "Fleet coverage total.",
+			},
+			[]string{"team", "cluster", "kernel_tree"},
+		),
+		fleetExecRateGauges: b.gaugeVec(
+			prometheus.GaugeOpts{
+				Name: "fleet_execs_per_second",
+				Help: "Fleet execs per second.",
+			},
+			[]string{"team", "cluster", "kernel_tree"},
+		),
+		fleetCrashesCounters: b.counterVec(
+			prometheus.CounterOpts{
+				Name: "fleet_crashes_total",
+				Help: "Fleet crashes total.",
+			},
+			[]string{"team", "cluster", "kernel_tree"},
+		),
+
+		droppedLabelCounters: b.dropped,
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	for name := range conf.Labels {
+		if !b.names[name] {
+			return nil, fmt.Errorf("labels of unknown metric %q", name)
+		}
+	}
+	return m, nil
+}
+
+// managerSeries returns the metrics labeled by manager only.
+func (m *metrics) managerSeries() []interface {
+	DeleteLabelValues(...string) bool
+} {
+	return []interface {
+		DeleteLabelValues(...string) bool
+	}{
+		m.jobPollCounters,
+		m.reproBudgetAttemptsGauges,
+		m.reproBudgetDeniedCounters,
+		m.managerLastSeenGauges,
+		m.managerUpGauges,
+		m.managerRestartCounters,
+		m.managerDuplicateStatsCounters,
+		m.managerExecRateGauges,
+		m.managerCrashRateGauges,
+		m.managerUptimeGauges,
+		m.managerCorpusGauges,
+		m.managerPCsGauges,
+		m.managerCoverageGauges,
+		m.managerCrashesCounters,
+		m.managerSuppCrashesCounters,
+		m.managerExecsCounters,
+		m.managerFuzzingDurCounters,
+	}
+}
+
+// deleteManagerSeries removes the series of a manager.
+func (m *metrics) deleteManagerSeries(manager string) {
+	for _, vec := range m.managerSeries() {
+		vec.DeleteLabelValues(manager)
+	}
+	for _, kind := range anomalyKinds {
+		m.managerAnomalyGauges.DeleteLabelValues(manager, kind)
+		m.managerAnomalyCounters.DeleteLabelValues(manager, kind)
+	}
+}
 
-func init() {
-	prometheus.MustRegister(rpcCounters)
-	prometheus.MustRegister(buildCounters)
-	prometheus.MustRegister(jobPollCounters)
-	prometheus.MustRegister(buildErrorCounters)
-	prometheus.MustRegister(managerUptimeGauges)
-	prometheus.MustRegister(managerCorpusGauges)
-	prometheus.MustRegister(managerPCsGauges)
-	prometheus.MustRegister(managerCoverageGauges)
-	prometheus.MustRegister(managerCrashesCounters)
-	prometheus.MustRegister(managerSuppCrashesCounters)
-	prometheus.MustRegister(managerExecsCounters)
-	prometheus.MustRegister(managerFuzzingDurCounters)
+// register registers the metrics of a proxy along with the Go runtime and
+// process metrics, which may already be registered when the registry is
+// shared.
+func (m *metrics) register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	} {
+		if err := reg.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	for _, c := range []prometheus.Collector{
+		m.rpcCounters,
+		m.throttledCounters,
+		m.writeCounters,
+		m.writeOutcomeCounters,
+		m.offlineGauge,
+		m.offlineReadCounters,
+		m.offlineWriteCounters,
+		m.offlineQueueGauges,
+		m.cacheCounters,
+		m.cacheEntriesGauges,
+		m.coalescedCounters,
+		m.cacheInvalidationCounters,
+		m.buildCounters,
+		m.jobPollCounters,
+		m.jobCounters,
+		m.jobExpiredCounters,
+		m.jobDoneCounters,
+		m.buildErrorCounters,
+		m.crashRuleCounters,
+		m.reproVoteCounters,
+		m.reproBudgetAttemptsGauges,
+		m.reproBudgetDeniedCounters,
+		m.managerLastSeenGauges,
+		m.managerUpGauges,
+		m.managerRestartCounters,
+		m.managerDuplicateStatsCounters,
+		m.managerExecRateGauges,
+		m.managerCrashRateGauges,
+		m.managerAnomalyGauges,
+		m.managerAnomalyCounters,
+		m.managerInfoGauges,
+		m.managerUptimeGauges,
+		m.managerCorpusGauges,
+		m.managerPCsGauges,
+		m.managerCoverageGauges,
+		m.managerCrashesCounters,
+		m.managerSuppCrashesCounters,
+		m.managerExecsCounters,
+		m.managerFuzzingDurCounters,
+		m.fleetManagersGauges,
+		m.fleetCorpusGauges,
+		m.fleetCoverageGauges,
+		m.fleetExecRateGauges,
+		m.fleetCrashesCounters,
+		m.droppedLabelCounters,
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,463 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+const (
+	// defaultRetryInterval is how often queued writes are redelivered by
+	// default.
+	defaultRetryInterval = time.Minute
+	// defaultQueueSize is the default number of queued writes.
+	defaultQueueSize = 10000
+	// defaultQueueBytes is the default size of the queued payloads.
+	defaultQueueBytes = 256 << 20
+	// defaultMaxAttempts is how many times a queued write that upstreams
+	// reject is redelivered by default.
+	defaultMaxAttempts = 3
+)
+
+// OfflineConfig configures the offline mode the proxy enters when every
+// upstream is unreachable.
+type OfflineConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// RetryInterval is how often queued writes are redelivered, it
+	// defaults to a minute.
+	RetryInterval time.Duration `yaml:"retry_interval"`
+	// QueueSize is the number of queued writes, the oldest ones are dropped
+	// when it is full.
+	QueueSize int `yaml:"queue_size"`
+	// QueueBytes is the size of the queued payloads in bytes, the oldest
+	// writes are dropped when it is exceeded. It defaults to 256MiB.
+	QueueBytes int64 `yaml:"queue_bytes"`
+	// MaxAttempts is how many times a queued write is redelivered when the
+	// upstream rejects it for a reason other than a transient error, it
+	// defaults to 3.
+	MaxAttempts int `yaml:"max_attempts"`
+	// ReportEmail is returned by builder_poll and commit_poll.
+	ReportEmail string `yaml:"report_email"`
+	// NeedRepro is the need_repro answer.
+	NeedRepro bool `yaml:"need_repro"`
+}
+
+func (conf *OfflineConfig) validate() error {
+	if conf.RetryInterval < 0 {
+		return fmt.Errorf("offline: negative retry interval")
+	}
+	if conf.QueueSize < 0 || conf.QueueBytes < 0 {
+		return fmt.Errorf("offline: negative queue size")
+	}
+	if conf.MaxAttempts < 0 {
+		return fmt.Errorf("offline: negative max attempts")
+	}
+	if conf.RetryInterval == 0 {
+		conf.RetryInterval = defaultRetryInterval
+	}
+	if conf.QueueSize == 0 {
+		conf.QueueSize = defaultQueueSize
+	}
+	if conf.QueueBytes == 0 {
+		conf.QueueBytes = defaultQueueBytes
+	}
+	if conf.MaxAttempts == 0 {
+		conf.MaxAttempts = defaultMaxAttempts
+	}
+	return nil
+}
+
+// queuedWrite is a write to an upstream that waits for redelivery, the
+// payload is the request as sent to the upstream. Queued writes are saved one
+// per file and their payload is only kept on disk.
+type queuedWrite struct {
+	Seq      uint64          `json:"seq"`
+	Upstream string          `json:"upstream"`
+	Method   string          `json:"method"`
+	Payload  json.RawMessage `json:"payload"`
+	Time     time.Time       `json:"time"`
+	// Attempts is the number of redeliveries the upstream rejected.
+	Attempts int `json:"attempts,omitempty"`
+
+	// size is the size of the payload.
+	size int
+}
+
+// offlineMode tracks if the upstreams are reachable and holds the writes
+// accepted while they were not.
+type offlineMode struct {
+	conf    OfflineConfig
+	dir     string
+	log     *slog.Logger
+	metrics *metrics
+
+	mu    sync.Mutex
+	down  bool
+	since time.Time
+	seq   uint64
+	queue []queuedWrite
+	// bytes is the size of the queued payloads.
+	bytes int64
+}
+
+// newOfflineMode returns the offline mode and loads the writes queued in
+// dir, without a dir the queued payloads are kept in memory.
+func newOfflineMode(conf OfflineConfig, dir string, log *slog.Logger, m *metrics) (*offlineMode, error) {
+	o := &offlineMode{
+		conf:    conf,
+		dir:     dir,
+		log:     log,
+		metrics: m,
+	}
+	if dir == "" {
+		return o, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var w queuedWrite
+		if err := json.Unmarshal(b, &w); err != nil {
+			return nil, fmt.Errorf("offline: %v: %v", fi.Name(), err)
+		}
+		w.size, w.Payload = len(w.Payload), nil
+		o.queue = append(o.queue, w)
+		o.bytes += int64(w.size)
+		if w.Seq > o.seq {
+			o.seq = w.Seq
+		}
+	}
+	sort.Slice(o.queue, func(i, j int) bool {
+		return o.queue[i].Seq < o.queue[j].Seq
+	})
+	o.trim()
+	o.update()
+	return o, nil
+}
+
+// path returns the file of a queued write.
+func (o *offlineMode) path(seq uint64) string {
+	return filepath.Join(o.dir, strconv.FormatUint(seq, 10)+".json")
+}
+
+// save writes a queued write with its payload to its file.
+func (o *offlineMode) save(w queuedWrite) error {
+	if o.dir == "" {
+		return nil
+	}
+	return writeFileAtomic(o.path(w.Seq), w)
+}
+
+// remove removes the file of a queued write.
+func (o *offlineMode) remove(w queuedWrite) {
+	o.bytes -= int64(w.size)
+	if o.dir == "" {
+		return
+	}
+	if err := os.Remove(o.path(w.Seq)); err != nil && !os.IsNotExist(err) {
+		o.log.Error("failed to remove queued write", "seq", w.Seq, "error", err)
+	}
+}
+
+// load returns a queued write with its payload.
+func (o *offlineMode) load(w queuedWrite) (queuedWrite, error) {
+	if w.Payload != nil || o.dir == "" {
+		return w, nil
+	}
+	b, err := ioutil.ReadFile(o.path(w.Seq))
+	if err != nil {
+		return w, err
+	}
+	err = json.Unmarshal(b, &w)
+	return w, err
+}
+
+// reachable records if any upstream answered a call.
+func (o *offlineMode) reachable(ok bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch {
+	case !ok && !o.down:
+		o.down, o.since = true, time.Now()
+		o.metrics.offlineGauge.Set(1)
+		o.log.Warn("upstreams unreachable, operating offline", "enabled", o.conf.Enabled)
+	case ok && o.down:
+		o.down = false
+		o.metrics.offlineGauge.Set(0)
+		o.log.Info("upstreams reachable, back online",
+			"offline", time.Since(o.since), "queued", len(o.queue))
+	}
+}
+
+// enqueue queues writes for redelivery.
+func (o *offlineMode) enqueue(writes ...queuedWrite) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, w := range writes {
+		o.seq++
+		w.Seq = o.seq
+		if err := o.save(w); err != nil {
+			o.log.Error("failed to save queued write", "upstream", w.Upstream, "method", w.Method, "error", err)
+			o.metrics.offlineWriteCounters.WithLabelValues(w.Method, w.Upstream, "dropped").Inc()
+			continue
+		}
+		w.size = len(w.Payload)
+		if o.dir != "" {
+			w.Payload = nil
+		}
+		o.queue = append(o.queue, w)
+		o.bytes += int64(w.size)
+		o.metrics.offlineWriteCounters.WithLabelValues(w.Method, w.Upstream, "queued").Inc()
+	}
+	o.trim()
+	o.update()
+}
+
+// trim drops the oldest writes while the queue is over its size or bytes.
+func (o *offlineMode) trim() {
+	n := 0
+	for ; n < len(o.queue); n++ {
+		if len(o.queue)-n <= o.conf.QueueSize && o.bytes <= o.conf.QueueBytes {
+			break
+		}
+		w := o.queue[n]
+		o.remove(w)
+		o.metrics.offlineWriteCounters.WithLabelValues(w.Method, w.Upstream, "dropped").Inc()
+	}
+	if n > 0 {
+		o.log.Warn("offline queue full, dropped writes", "dropped", n)
+		o.queue = append([]queuedWrite(nil), o.queue[n:]...)
+	}
+}
+
+// pending returns the queued writes by upstream in queue order.
+func (o *offlineMode) pending() map[string][]queuedWrite {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	writes := map[string][]queuedWrite{}
+	for _, w := range o.queue {
+		writes[w.Upstream] = append(writes[w.Upstream], w)
+	}
+	return writes
+}
+
+// delivered removes delivered writes from the queue and counts the attempts
+// of rejected ones, which are dropped after MaxAttempts.
+func (o *offlineMode) delivered(delivered, rejected map[uint64]bool) {
+	if len(delivered) == 0 && len(rejected) == 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	queue := o.queue[:0]
+	for _, w := range o.queue {
+		if delivered[w.Seq] {
+			o.remove(w)
+			o.metrics.offlineWriteCounters.WithLabelValues(w.Method, w.Upstream, "delivered").Inc()
+			continue
+		}
+		if rejected[w.Seq] {
+			if w.Attempts++; w.Attempts >= o.conf.MaxAttempts {
+				o.remove(w)
+				o.metrics.offlineWriteCounters.WithLabelValues(w.Method, w.Upstream, "rejected").Inc()
+				o.log.Warn("queued write rejected, dropped",
+					"upstream", w.Upstream, "method", w.Method, "attempts", w.Attempts)
+				continue
+			}
+			o.saveAttempts(w)
+		}
+		queue = append(queue, w)
+	}
+	o.queue = queue
+	o.update()
+}
+
+// saveAttempts saves the attempts of a rejected write with its payload.
+func (o *offlineMode) saveAttempts(w queuedWrite) {
+	if o.dir == "" {
+		return
+	}
+	attempts := w.Attempts
+	w, err := o.load(w)
+	if err == nil {
+		w.Attempts = attempts
+		err = o.save(w)
+	}
+	if err != nil {
+		o.log.Error("failed to save queued write", "seq", w.Seq, "error", err)
+	}
+}
+
+// update updates the queue length metrics.
+func (o *offlineMode) update() {
+	lengths := map[string]int{}
+	for _, w := range o.queue {
+		lengths[w.Upstream]++
+	}
+	var series []gaugeSeries
+	for upstream, n := range lengths {
+		series = append(series, gaugeSeries{[]string{upstream}, float64(n)})
+	}
+	o.metrics.offlineQueueGauges.replace(series)
+}
+
+// offlineDefault responds to a read that no upstream answered with its
+// offline default, it returns false when offline mode is disabled.
+func (p *proxy) offlineDefault(c *gin.Context, method string, resp interface{}) bool {
+	if !p.offline.conf.Enabled {
+		return false
+	}
+	p.metrics.offlineReadCounters.WithLabelValues(method).Inc()
+	p.logger(c).Debug("offline default served")
+	c.JSON(http.StatusOK, resp)
+	return true
+}
+
+// queue queues a write that no upstream accepted for every upstream, it
+// returns false when offline mode is disabled.
+func (p *proxy) queue(c *gin.Context, fn func(*dashapi.Dashboard) error) bool {
+	if !p.offline.conf.Enabled {
+		return false
+	}
+	var writes []queuedWrite
+	for _, addr := range p.order {
+		w, err := p.record(addr, fn)
+		if err != nil {
+			p.logger(c).Error("failed to queue write", "upstream", addr, "error", err)
+			return false
+		}
+		writes = append(writes, *w)
+	}
+	p.offline.enqueue(writes...)
+	p.logger(c).Info("write queued")
+	return true
+}
+
+// record returns the call fn makes to an upstream without sending it.
+func (p *proxy) record(addr string, fn func(*dashapi.Dashboard) error) (*queuedWrite, error) {
+	p.dashMu.RLock()
+	dash := p.dashes[addr]
+	p.dashMu.RUnlock()
+	var w *queuedWrite
+	doer := func(r *http.Request) (*http.Response, error) {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		gz, err := gzip.NewReader(bytes.NewBufferString(r.PostForm.Get("payload")))
+		if err != nil {
+			return nil, err
+		}
+		payload, err := ioutil.ReadAll(gz)
+		if err != nil {
+			return nil, err
+		}
+		w = &queuedWrite{
+			Upstream: addr,
+			Method:   r.PostForm.Get("method"),
+			Payload:  payload,
+			Time:     time.Now(),
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("null")),
+		}, nil
+	}
+	rec := dashapi.NewCustom(dash.Client, dash.Addr, dash.Key, http.NewRequest, doer, nil, nil)
+	if err := fn(rec); err != nil {
+		return nil, err
+	}
+	if w == nil {
+		return nil, fmt.Errorf("no call to record")
+	}
+	return w, nil
+}
+
+// redeliverQueued sends the queued writes to their upstreams in order,
+// delivery to an upstream stops at its first transient failure. Writes the
+// upstream rejects are skipped and retried up to MaxAttempts times.
+func (p *proxy) redeliverQueued() {
+	var (
+		delivered = map[uint64]bool{}
+		rejected  = map[uint64]bool{}
+		answered  bool
+	)
+	for addr, writes := range p.offline.pending() {
+		p.dashMu.RLock()
+		upstream, ok := p.dashes[addr]
+		p.dashMu.RUnlock()
+		if !ok {
+			continue
+		}
+		status := 0
+		dash := p.dashboard(context.Background(), upstream, &status)
+		for _, w := range writes {
+			w, err := p.offline.load(w)
+			if err != nil {
+				// A write whose payload is lost can never be delivered.
+				p.log.Error("failed to load queued write", "upstream", addr, "seq", w.Seq, "error", err)
+				rejected[w.Seq] = true
+				continue
+			}
+			status = 0
+			err = dash.Query(w.Method, w.Payload, nil)
+			if err == nil {
+				delivered[w.Seq] = true
+				answered = true
+				continue
+			}
+			p.log.Warn("redelivery failed", "upstream", addr, "method", w.Method, "error", err)
+			if transient(&upstreamError{err, status}) {
+				break
+			}
+			rejected[w.Seq] = true
+			answered = true
+		}
+	}
+	if answered {
+		p.offline.reachable(true)
+	}
+	if len(delivered) > 0 {
+		p.log.Info("queued writes redelivered", "delivered", len(delivered))
+	}
+	p.offline.delivered(delivered, rejected)
+}
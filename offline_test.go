@@ -0,0 +1,142 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+func TestOfflineReads(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// statuses are the answers of the primary and the second upstream.
+		statuses [2]int
+		ok       bool
+	}{
+		{"unreachable", [2]int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, true},
+		{"rejected by the primary", [2]int{http.StatusBadRequest, http.StatusServiceUnavailable}, false},
+		{"rejected by every upstream", [2]int{http.StatusBadRequest, http.StatusBadRequest}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			upstreams := []*fakeDashboard{newFakeDashboard(t), newFakeDashboard(t)}
+			for i, u := range upstreams {
+				u.setStatus(test.statuses[i])
+			}
+			_, client := newTestProxy(t, &Config{
+				Offline: OfflineConfig{Enabled: true, NeedRepro: true},
+			}, upstreams...)
+
+			for _, read := range []struct {
+				method string
+				call   func() error
+			}{
+				{"builder_poll", func() error {
+					_, err := client.BuilderPoll("m")
+					return err
+				}},
+				{"job_poll", func() error {
+					_, err := client.JobPoll(&dashapi.JobPollReq{
+						Managers: map[string]dashapi.ManagerJobs{"m": {TestPatches: true}},
+					})
+					return err
+				}},
+				{"commit_poll", func() error {
+					_, err := client.CommitPoll()
+					return err
+				}},
+				{"need_repro", func() error {
+					_, err := client.NeedRepro(&dashapi.CrashID{BuildID: "b", Title: "crash"})
+					return err
+				}},
+			} {
+				if err := read.call(); (err == nil) != test.ok {
+					t.Errorf("%v: got error %v, want ok %v", read.method, err, test.ok)
+				}
+			}
+		})
+	}
+}
+
+func TestOfflineRedelivery(t *testing.T) {
+	upstream := newFakeDashboard(t)
+	upstream.setStatus(http.StatusServiceUnavailable)
+	conf := &Config{
+		StateDir: t.TempDir(),
+		Offline:  OfflineConfig{Enabled: true},
+	}
+	_, client := newTestProxy(t, conf, upstream)
+	for _, id := range []string{"b1", "b2"} {
+		if err := client.UploadBuild(&dashapi.Build{Manager: "m", ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(conf.StateDir, "offline", "*.json"))
+	if len(files) != 2 {
+		t.Fatalf("got %v queued write files, want 2", len(files))
+	}
+
+	// A restarted proxy picks up the queue and delivers it once the
+	// upstream is back.
+	upstream.setStatus(http.StatusOK)
+	p, _ := newTestProxy(t, conf, upstream)
+	p.redeliverQueued()
+	upstream.mu.Lock()
+	calls := upstream.calls
+	upstream.mu.Unlock()
+	if calls != 4 {
+		t.Errorf("got %v upstream calls, want 4", calls)
+	}
+	if n := len(p.offline.pending()); n != 0 {
+		t.Errorf("got %v upstreams with queued writes, want 0", n)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(conf.StateDir, "offline")); len(entries) != 0 {
+		t.Errorf("got %v files left, want 0", len(entries))
+	}
+}
+
+func TestOfflineQueueBytes(t *testing.T) {
+	upstream := newFakeDashboard(t)
+	upstream.setStatus(http.StatusServiceUnavailable)
+	payload, err := json.Marshal(&dashapi.Build{Manager: "m", ID: "b1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// There is room for two and a half payloads.
+	limit := int64(len(payload) * 5 / 2)
+	p, client := newTestProxy(t, &Config{
+		Offline: OfflineConfig{Enabled: true, QueueBytes: limit},
+	}, upstream)
+	for _, id := range []string{"b1", "b2", "b3"} {
+		if err := client.UploadBuild(&dashapi.Build{Manager: "m", ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.offline.mu.Lock()
+	defer p.offline.mu.Unlock()
+	var seqs []uint64
+	for _, w := range p.offline.queue {
+		seqs = append(seqs, w.Seq)
+	}
+	if !reflect.DeepEqual(seqs, []uint64{2, 3}) || p.offline.bytes > limit {
+		t.Errorf("got queued writes %v of %v bytes, want [2 3] within %v bytes", seqs, p.offline.bytes, limit)
+	}
+}
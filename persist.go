@@ -0,0 +1,150 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// defaultSnapshotInterval is how often manager metrics are saved by default.
+const defaultSnapshotInterval = time.Minute
+
+// persisted returns the manager metrics that survive restarts by their
+// unprefixed name.
+func (m *metrics) persisted() map[string]prometheus.Collector {
+	return map[string]prometheus.Collector{
+		"manager_uptime_total":                m.managerUptimeGauges,
+		"manager_corpus_total":                m.managerCorpusGauges,
+		"manager_pcs_total":                   m.managerPCsGauges,
+		"manager_coverage_total":              m.managerCoverageGauges,
+		"manager_crashes_total":               m.managerCrashesCounters,
+		"manager_supp_crashes_total":          m.managerSuppCrashesCounters,
+		"manager_execs_total":                 m.managerExecsCounters,
+		"manager_fuzzing_dur_total":           m.managerFuzzingDurCounters,
+		"manager_restarts_total":              m.managerRestartCounters,
+		"manager_stats_duplicates_total":      m.managerDuplicateStatsCounters,
+		"manager_execs_per_second":            m.managerExecRateGauges,
+		"manager_crashes_per_hour":            m.managerCrashRateGauges,
+		"manager_last_seen_timestamp_seconds": m.managerLastSeenGauges,
+		"manager_up":                          m.managerUpGauges,
+		"fleet_crashes_total":                 m.fleetCrashesCounters,
+	}
+}
+
+// series is a saved metric series.
+type series struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// metricsSnapshot is the saved state of the managers and their metrics.
+type metricsSnapshot struct {
+	Time     time.Time           `json:"time"`
+	Managers []managerInfo       `json:"managers"`
+	Metrics  map[string][]series `json:"metrics"`
+}
+
+// saveMetrics saves the managers and their metrics to the snapshot file.
+func (p *proxy) saveMetrics() {
+	if p.snapshotPath == "" {
+		return
+	}
+	snap := metricsSnapshot{
+		Time:     time.Now(),
+		Managers: p.managers.list(),
+		Metrics:  map[string][]series{},
+	}
+	for name, c := range p.metrics.persisted() {
+		snap.Metrics[name] = collect(c)
+	}
+	if err := writeFileAtomic(p.snapshotPath, snap); err != nil {
+		p.log.Error("failed to save metrics", "path", p.snapshotPath, "error", err)
+	}
+}
+
+// loadMetrics restores the managers and their metrics from the snapshot
+// file.
+func (p *proxy) loadMetrics() error {
+	if p.snapshotPath == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(p.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap metricsSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return err
+	}
+	p.managers.restore(snap.Managers)
+	// Series whose labels no longer match their metric are dropped.
+	persisted := p.metrics.persisted()
+	for name, ss := range snap.Metrics {
+		for _, s := range ss {
+			switch vec := persisted[name].(type) {
+			case *counterVec:
+				if c, err := vec.GetMetricWith(s.Labels); err == nil {
+					c.Add(s.Value)
+				}
+			case *gaugeVec:
+				if g, err := vec.GetMetricWith(s.Labels); err == nil {
+					g.Set(s.Value)
+				}
+			}
+		}
+	}
+	p.log.Info("metrics restored", "path", p.snapshotPath,
+		"managers", len(snap.Managers), "age", time.Since(snap.Time))
+	return nil
+}
+
+// collect returns the series of a metric.
+func collect(c prometheus.Collector) []series {
+	var (
+		ss = []series{}
+		ch = make(chan prometheus.Metric)
+	)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			continue
+		}
+		s := series{Labels: map[string]string{}}
+		for _, l := range pb.Label {
+			s.Labels[l.GetName()] = l.GetValue()
+		}
+		switch {
+		case pb.Counter != nil:
+			s.Value = pb.Counter.GetValue()
+		case pb.Gauge != nil:
+			s.Value = pb.Gauge.GetValue()
+		}
+		ss = append(ss, s)
+	}
+	return ss
+}
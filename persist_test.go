@@ -0,0 +1,64 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsRestore(t *testing.T) {
+	upstream := newFakeDashboard(t)
+	conf := &Config{StateDir: t.TempDir()}
+	p, client := newTestProxy(t, conf, upstream)
+	if err := client.UploadBuild(&dashapi.Build{ID: "b1", Manager: "m", OS: "linux", Arch: "amd64"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.UploadManagerStats(&dashapi.ManagerStatsReq{Name: "m", UpTime: time.Minute, Execs: 60, Crashes: 2}); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	// The restarted proxy continues the counters and knows the manager and
+	// its last upload, which the manager sends again after a failed one.
+	p, client = newTestProxy(t, conf, upstream)
+	managers := p.managers.list()
+	if len(managers) != 1 || managers[0].Name != "m" || managers[0].BuildID != "b1" || managers[0].UpTime != time.Minute {
+		t.Fatalf("got managers %+v, want m on b1 up for a minute", managers)
+	}
+	if err := client.UploadManagerStats(&dashapi.ManagerStatsReq{Name: "m", UpTime: time.Minute, Execs: 60, Crashes: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.UploadManagerStats(&dashapi.ManagerStatsReq{Name: "m", UpTime: 2 * time.Minute, Execs: 120, Crashes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"execs", testutil.ToFloat64(p.metrics.managerExecsCounters.WithLabelValues("m")), 180},
+		{"crashes", testutil.ToFloat64(p.metrics.managerCrashesCounters.WithLabelValues("m")), 3},
+		{"duplicates", testutil.ToFloat64(p.metrics.managerDuplicateStatsCounters.WithLabelValues("m")), 1},
+		{"restarts", testutil.ToFloat64(p.metrics.managerRestartCounters.WithLabelValues("m")), 0},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
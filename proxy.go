@@ -20,51 +20,346 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"os"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/syzkaller/dashboard/dashapi"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
-	errUnknownMethod = errors.New("unknown method")
+	errUnknownMethod   = errors.New("unknown method")
+	errUnknownUpstream = errors.New("unknown upstream")
 )
 
 // Proxy is a syzkaller dashboard proxy.
 type Proxy interface {
 	Proxy(*gin.Context)
 	Metrics(*gin.Context)
+	ReproBudget(*gin.Context)
+	Managers(*gin.Context)
+	History(*gin.Context)
+	Anomalies(*gin.Context)
+	LocalCrashes(*gin.Context)
+	// Close stops the background work of the proxy and saves its state.
+	Close() error
 }
 
 type proxy struct {
 	dashMu sync.RWMutex
 	dashes map[string]*dashapi.Dashboard
+	// order is the order of the upstreams on the command line, the first
+	// one is the primary.
+	order []string
+
+	log        *slog.Logger
+	registry   *prometheus.Registry
+	metrics    *metrics
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	limiter    *rateLimiter
+	upstreams  map[string]UpstreamConfig
+	crashRules []*CrashRule
+	// localCrashes keeps the crashes of local crash rules.
+	localCrashes *localCrashStore
+
+	builds   *buildStore
+	managers *managerRegistry
+
+	jobs        *jobQueue
+	jobFallback string
+	// bugOrigins maps bug IDs to the upstream that reported them.
+	bugOrigins *routeStore
+
+	writePolicies map[string]WritePolicy
+
+	repro       ReproConfig
+	reproBudget *reproBudget
+
+	offline *offlineMode
+	cache   *responseCache
+	// flights coalesces identical concurrent polls.
+	flights singleflight.Group
+
+	snapshotPath     string
+	snapshotInterval time.Duration
+	history          *historyStore
+	anomalies        *anomalyDetector
+
+	// stop is closed to stop the background loops of the proxy, wg waits
+	// for them.
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 }
 
 // New returns a new proxy
-func New(forward []string) Proxy {
-	dashes := map[string]*dashapi.Dashboard{}
+func New(forward []string, conf *Config) (Proxy, error) {
+	if conf == nil {
+		conf = &Config{}
+	}
+	log := conf.Logger
+	if log == nil {
+		log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	tp := conf.TracerProvider
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+	reg := conf.Registry
+	if reg == nil {
+		reg = prometheus.NewRegistry()
+	}
+	m, err := newMetrics(conf.Metrics)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		dashes = map[string]*dashapi.Dashboard{}
+		order  []string
+	)
 	for _, f := range forward {
+		if _, ok := dashes[f]; ok {
+			continue
+		}
 		dashes[f] = dashapi.New("proxy", f, "")
+		order = append(order, f)
+	}
+	limiter, err := newRateLimiter(conf.RateLimits)
+	if err != nil {
+		return nil, err
+	}
+	for addr, u := range conf.Upstreams {
+		if _, ok := dashes[addr]; !ok {
+			return nil, fmt.Errorf("config for unknown upstream %q", addr)
+		}
+		for _, r := range u.Rewrite {
+			if err := r.compile(); err != nil {
+				return nil, fmt.Errorf("upstream %q: %v", addr, err)
+			}
+		}
+	}
+	for _, r := range conf.CrashRules {
+		if err := r.compile(); err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.LocalCrashes.validate(); err != nil {
+		return nil, err
+	}
+	if conf.StateDir != "" {
+		if err := os.MkdirAll(conf.StateDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.Builds.validate(); err != nil {
+		return nil, err
+	}
+	builds, err := newBuildStore(conf.statePath("builds.json"), conf.Builds.Size, log)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.Jobs.validate(len(order)); err != nil {
+		return nil, err
+	}
+	if err := conf.NeedRepro.validate(len(order)); err != nil {
+		return nil, err
 	}
-	return &proxy{
-		dashes: dashes,
+	jobOrigins, err := newRouteStore(conf.statePath("jobs.json"), conf.Jobs.OriginTTL, log)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := newJobQueue(conf.Jobs, conf.statePath("pending_jobs.json"), order, jobOrigins, log, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.Bugs.validate(); err != nil {
+		return nil, err
+	}
+	for method, w := range conf.WritePolicies {
+		if err := w.validate(len(order)); err != nil {
+			return nil, fmt.Errorf("write policy of %s: %v", method, err)
+		}
+	}
+	bugOrigins, err := newRouteStore(conf.statePath("bugs.json"), conf.Bugs.OriginTTL, log)
+	if err != nil {
+		return nil, err
+	}
+	// Saved routes may name upstreams that are no longer forwarded to,
+	// their IDs are handled like unknown ones.
+	known := func(addr string) bool {
+		_, ok := dashes[addr]
+		return ok
+	}
+	if n := jobOrigins.retain(known); n > 0 {
+		log.Warn("job routes of unknown upstreams dropped", "jobs", n)
+	}
+	if n := bugOrigins.retain(known); n > 0 {
+		log.Warn("bug routes of unknown upstreams dropped", "bugs", n)
+	}
+	if err := conf.Offline.validate(); err != nil {
+		return nil, err
+	}
+	offline, err := newOfflineMode(conf.Offline, conf.statePath("offline"), log, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.Managers.validate(); err != nil {
+		return nil, err
+	}
+	if err := conf.History.validate(conf.StateDir); err != nil {
+		return nil, err
+	}
+	history, err := newHistoryStore(conf.History, conf.statePath("history"), log)
+	if err != nil {
+		return nil, err
 	}
+	for _, l := range conf.ManagerLabels {
+		if err := l.compile(); err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.Anomalies.validate(); err != nil {
+		return nil, err
+	}
+	for method, cc := range conf.Cache {
+		if err := cc.validate(method); err != nil {
+			return nil, err
+		}
+		conf.Cache[method] = cc
+	}
+	if err := m.register(reg); err != nil {
+		return nil, err
+	}
+	anomalies := newAnomalyDetector(conf.Anomalies, log, m)
+	p := &proxy{
+		dashes:   dashes,
+		order:    order,
+		log:      log,
+		registry: reg,
+		metrics:  m,
+		tracer:   tp.Tracer(tracerName),
+		propagator: propagation.NewCompositeTextMapPropagator(
+			propagation.TraceContext{},
+			propagation.Baggage{},
+		),
+		limiter:       limiter,
+		upstreams:     conf.Upstreams,
+		crashRules:    conf.CrashRules,
+		localCrashes:  newLocalCrashStore(conf.LocalCrashes, conf.statePath("local_crashes.jsonl"), log),
+		builds:        builds,
+		managers:      newManagerRegistry(conf.Managers, conf.ManagerLabels, anomalies, log, m),
+		jobs:          jobs,
+		jobFallback:   conf.Jobs.Fallback,
+		bugOrigins:    bugOrigins,
+		writePolicies: conf.WritePolicies,
+		repro:         conf.NeedRepro,
+		reproBudget:   newReproBudget(conf.ReproBudget, m),
+		offline:       offline,
+		cache:         newResponseCache(conf.Cache, m),
+
+		snapshotPath:     conf.statePath("metrics.json"),
+		snapshotInterval: conf.Managers.SnapshotInterval,
+		history:          history,
+		anomalies:        anomalies,
+
+		stop: make(chan struct{}),
+	}
+	if err := p.loadMetrics(); err != nil {
+		return nil, err
+	}
+	if conf.Offline.Enabled {
+		p.every(p.offline.conf.RetryInterval, p.redeliverQueued)
+	}
+	p.every(p.managers.checkInterval(), p.managers.check)
+	if p.snapshotPath != "" {
+		p.every(p.snapshotInterval, p.saveMetrics)
+	}
+	if history != nil {
+		p.every(historyCompactInterval, history.compact)
+	}
+	return p, nil
+}
+
+// every calls fn every interval until the proxy is closed.
+func (p *proxy) every(interval time.Duration, fn func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close implements the Proxy interface.
+func (p *proxy) Close() error {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		p.wg.Wait()
+		p.saveMetrics()
+	})
+	return nil
 }
 
 // Metrics implements the metrics interface.
 func (p *proxy) Metrics(c *gin.Context) {
-	promhttp.Handler().ServeHTTP(c.Writer, c.Request)
+	promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{}).ServeHTTP(c.Writer, c.Request)
 }
 
 // Proxy implements the Proxy interface.
 func (p *proxy) Proxy(c *gin.Context) {
-	client := c.PostForm("client")
-	key := c.PostForm("key")
-	method := c.PostForm("method")
-	fmt.Printf("client: %q, key: %q, method: %q", client, key, method)
+	var (
+		start     = time.Now()
+		client    = c.PostForm("client")
+		key       = c.PostForm("key")
+		method    = c.PostForm("method")
+		requestID = c.GetHeader(requestIDHeader)
+	)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	c.Header(requestIDHeader, requestID)
+	log := p.log.With("request_id", requestID, "client", client, "method", method)
+	c.Set(logContextKey, log)
+
+	ctx := p.propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	ctx, span := p.tracer.Start(ctx, "dashapi "+method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("syz.client", client),
+			attribute.String("syz.method", method),
+			attribute.String("request_id", requestID),
+		),
+	)
+	c.Request = c.Request.WithContext(ctx)
+	defer func() {
+		span.SetAttributes(attribute.Int("http.response.status_code", c.Writer.Status()))
+		span.End()
+		log.Info("request",
+			"status", c.Writer.Status(),
+			"duration", time.Since(start),
+		)
+	}()
 
 	switch method {
 	case "upload_build":
@@ -99,608 +394,695 @@ func (p *proxy) Proxy(c *gin.Context) {
 		p.reportingUpdate(c, client, key)
 	case "manager_stats":
 		p.managerStats(c, client, key)
-		rpcCounters.WithLabelValues(client, method).Inc()
+		p.metrics.rpcCounters.WithLabelValues(client, method).Inc()
 		return
 	case "bug_list":
 		p.bugList(c, client, key)
 	case "load_bug":
 		p.loadBug(c, client, key)
 	default:
-		rpcCounters.WithLabelValues(client, "invalid").Inc()
+		p.metrics.rpcCounters.WithLabelValues(client, "invalid").Inc()
 		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
 		return
 	}
-	rpcCounters.WithLabelValues(client, method).Inc()
+	p.metrics.rpcCounters.WithLabelValues(client, method).Inc()
 }
 
-func (p *proxy) uploadBuild(c *gin.Context, client, key string) {
-	var (
-		build dashapi.Build
-		// Payload is gzip'd json.
-		payload = c.PostForm("payload")
-		buf     = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
+// decode decodes the gzip'd json payload of a request.
+func decode(c *gin.Context, v interface{}) (err error) {
+	_, span := startSpan(c, "decode")
+	defer func() { endSpan(span, err) }()
+	r, err := gzip.NewReader(bytes.NewBufferString(c.PostForm("payload")))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-		return
+		return err
+	}
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return err
 	}
-	d := json.NewDecoder(r)
+	return r.Close()
+}
 
-	if err := d.Decode(&build); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-		return
+// upstreamError is the error of an upstream call along with the HTTP status
+// of the upstream's answer, 0 if it did not answer.
+type upstreamError struct {
+	err    error
+	status int
+}
+
+func (e *upstreamError) Error() string { return e.err.Error() }
+
+func (e *upstreamError) Unwrap() error { return e.err }
+
+// transient returns if an upstream call may succeed when it is retried: the
+// upstream did not answer, timed out, throttled the call or failed itself.
+func transient(err error) bool {
+	var ue *upstreamError
+	if !errors.As(err, &ue) {
+		return false
+	}
+	switch {
+	case ue.status == 0, ue.status == http.StatusRequestTimeout,
+		ue.status == http.StatusTooManyRequests, ue.status >= 500:
+		return true
 	}
+	return false
+}
 
-	if err := r.Close(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-		return
+// call calls fn on an upstream dashboard and logs the outcome.
+func (p *proxy) call(c *gin.Context, addr string, fn func(*dashapi.Dashboard) error) error {
+	ctx, span := startSpan(c, "upstream "+c.PostForm("method"),
+		attribute.String("syz.upstream", addr),
+	)
+	start := time.Now()
+	var err error
+	if dash, ok := p.dashes[addr]; ok {
+		status := 0
+		if err = fn(p.dashboard(ctx, dash, &status)); err != nil {
+			err = &upstreamError{err, status}
+		}
+	} else {
+		err = errUnknownUpstream
 	}
+	endSpan(span, err)
+	log := p.logger(c).With("upstream", addr, "duration", time.Since(start))
+	if err != nil {
+		log.Warn("upstream failed", "error", err)
+		return err
+	}
+	log.Debug("upstream ok")
+	return nil
+}
 
+// forward calls fn for every upstream dashboard in order, it stops at the
+// first upstream that fails.
+func (p *proxy) forward(c *gin.Context, fn func(*dashapi.Dashboard) error) error {
 	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		err := dash.UploadBuild(&build)
-		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-			return
+	defer p.dashMu.RUnlock()
+	for _, addr := range p.order {
+		if err := p.call(c, addr, fn); err != nil {
+			return err
 		}
 	}
-	p.dashMu.RUnlock()
+	return nil
 }
 
-func (p *proxy) builderPoll(c *gin.Context, client, key string) {
+// gather calls fn for every upstream dashboard concurrently and returns the
+// results by upstream, it only fails if every upstream failed. The error is
+// transient only if every upstream failed with a transient error.
+func gather[T any](p *proxy, c *gin.Context, fn func(*dashapi.Dashboard) (T, error)) (map[string]T, error) {
+	results, errs := gatherErrors(p, c, fn)
+	if len(results) != 0 {
+		return results, nil
+	}
+	var first error
+	for _, addr := range p.order {
+		err, ok := errs[addr]
+		switch {
+		case !ok:
+		case !transient(err):
+			return nil, err
+		case first == nil:
+			first = err
+		}
+	}
+	return results, first
+}
+
+// gatherErrors is gather that returns the errors of the upstreams that
+// failed. Upstreams that failed for a reason other than a transient error
+// still count as reachable.
+func gatherErrors[T any](p *proxy, c *gin.Context, fn func(*dashapi.Dashboard) (T, error)) (map[string]T, map[string]error) {
 	var (
-		pollReq dashapi.BuilderPollReq
-		payload = c.PostForm("payload")
-		buf     = bytes.NewBufferString(payload)
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		answered bool
+		results  = map[string]T{}
+		errs     = map[string]error{}
 	)
-	r, err := gzip.NewReader(buf)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	p.dashMu.RLock()
+	defer p.dashMu.RUnlock()
+	for _, addr := range p.order {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			var res T
+			err := p.call(c, addr, func(dash *dashapi.Dashboard) error {
+				var err error
+				res, err = fn(dash)
+				return err
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[addr] = err
+				answered = answered || !transient(err)
+				return
+			}
+			answered = true
+			results[addr] = res
+		}(addr)
+	}
+	wg.Wait()
+	p.offline.reachable(answered)
+	return results, errs
+}
+
+func (p *proxy) uploadBuild(c *gin.Context, client, key string) {
+	var build dashapi.Build
+	if err := decode(c, &build); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
-
-	if err := d.Decode(&pollReq); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	if !p.allow(c, client, build.Manager, "upload_build") {
 		return
 	}
+	p.builds.add(build.ID, build.Manager)
+	p.managers.build(client, &build)
+	p.metrics.buildCounters.WithLabelValues(build.Manager, build.ID, build.OS, build.Arch, build.VMArch).Inc()
 
-	if err := r.Close(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	p.write(c, "upload_build", func(dash *dashapi.Dashboard) error {
+		return dash.UploadBuild(rewrite(p, dash, "upload_build", &build))
+	})
+}
+
+func (p *proxy) builderPoll(c *gin.Context, client, key string) {
+	var pollReq dashapi.BuilderPollReq
+	if err := decode(c, &pollReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !p.allow(c, client, pollReq.Manager, "builder_poll") {
 		return
 	}
 
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		_, err := dash.BuilderPoll(pollReq.Manager)
+	merged, err := coalesce(p, c, "builder_poll", &pollReq, func() (*dashapi.BuilderPollResp, error) {
+		resps, err := gather(p, c, func(dash *dashapi.Dashboard) (*dashapi.BuilderPollResp, error) {
+			return dash.BuilderPoll(rewrite(p, dash, "builder_poll", &pollReq).Manager)
+		})
 		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+			return nil, err
+		}
+		return p.mergeBuilderPoll(resps), nil
+	})
+	if err != nil {
+		if transient(err) && p.offlineDefault(c, "builder_poll", &dashapi.BuilderPollResp{
+			ReportEmail: p.offline.conf.ReportEmail,
+		}) {
 			return
 		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+		return
 	}
-	p.dashMu.RUnlock()
+	c.JSON(http.StatusOK, merged)
 }
 
 func (p *proxy) jobPoll(c *gin.Context, client, key string) {
-	var (
-		jobPollReq dashapi.JobPollReq
-		payload    = c.PostForm("payload")
-		buf        = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	var jobPollReq dashapi.JobPollReq
+	if err := decode(c, &jobPollReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
-
-	if err := d.Decode(&jobPollReq); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-		return
+	managers := make([]string, 0, len(jobPollReq.Managers))
+	for manager := range jobPollReq.Managers {
+		managers = append(managers, manager)
 	}
-
-	if err := r.Close(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	sort.Strings(managers)
+	if !p.allowManagers(c, client, managers, "job_poll") {
 		return
 	}
-
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		_, err := dash.JobPoll(&jobPollReq)
+	for manager := range jobPollReq.Managers {
+		p.metrics.jobPollCounters.WithLabelValues(manager).Inc()
+	}
+	p.managers.poll(client, jobPollReq.Managers)
+
+	// Jobs left over from earlier polls are handed out before asking the
+	// upstreams for more. Identical polls share the upstream round trip but
+	// take their jobs from the queue one by one.
+	job, origin := p.jobs.take(jobPollReq.Managers)
+	if job == nil {
+		_, err := coalesce(p, c, "job_poll", &jobPollReq, func() (struct{}, error) {
+			resps, err := gather(p, c, func(dash *dashapi.Dashboard) (*dashapi.JobPollResp, error) {
+				resp, err := dash.JobPoll(rewrite(p, dash, "job_poll", &jobPollReq))
+				if err == nil && resp.ID != "" {
+					resp.Manager = polledManager(p, dash, jobPollReq.Managers, resp.Manager)
+				}
+				return resp, err
+			})
+			for addr, resp := range resps {
+				if resp.ID != "" {
+					p.jobs.add(addr, resp)
+				}
+			}
+			return struct{}{}, err
+		})
 		if err != nil {
-			p.dashMu.RUnlock()
+			if transient(err) && p.offlineDefault(c, "job_poll", &dashapi.JobPollResp{}) {
+				return
+			}
 			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
 			return
 		}
+		job, origin = p.jobs.take(jobPollReq.Managers)
 	}
-	p.dashMu.RUnlock()
+	if job == nil {
+		c.JSON(http.StatusOK, &dashapi.JobPollResp{})
+		return
+	}
+	p.metrics.jobCounters.WithLabelValues(origin).Inc()
+	p.logger(c).Info("job handed out", "job", job.ID, "manager", job.Manager, "upstream", origin)
+	c.JSON(http.StatusOK, job)
 }
 
 func (p *proxy) jobDone(c *gin.Context, client, key string) {
-	var (
-		jobDoneReq dashapi.JobDoneReq
-		payload    = c.PostForm("payload")
-		buf        = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	var jobDoneReq dashapi.JobDoneReq
+	if err := decode(c, &jobDoneReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
-
-	if err := d.Decode(&jobDoneReq); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	if !p.allow(c, client, jobDoneReq.Build.Manager, "job_done") {
 		return
 	}
-
-	if err := r.Close(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-		return
-	}
-
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		err := dash.JobDone(&jobDoneReq)
-		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	build := &jobDoneReq.Build
+	p.metrics.jobDoneCounters.WithLabelValues(jobDoneReq.ID, build.Manager, build.ID, build.OS, build.Arch, build.VMArch).Inc()
+
+	jobDone := func(dash *dashapi.Dashboard) error {
+		return dash.JobDone(rewrite(p, dash, "job_done", &jobDoneReq))
+	}
+	// Jobs are only known to the upstream that issued them.
+	origin, ok := p.jobs.origin(jobDoneReq.ID)
+	if !ok {
+		p.logger(c).Warn("job upstream unknown", "job", jobDoneReq.ID, "fallback", p.jobFallback)
+		switch p.jobFallback {
+		case JobFallbackBroadcast:
+			if _, err := gather(p, c, func(dash *dashapi.Dashboard) (struct{}, error) {
+				return struct{}{}, jobDone(dash)
+			}); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+			}
+			return
+		case JobFallbackPrimary:
+			origin = p.order[0]
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownJob.Error()})
 			return
 		}
 	}
-	p.dashMu.RUnlock()
-}
-
-func (p *proxy) reportBuildError(c *gin.Context, client, key string) {
-	var (
-		buildErrReq dashapi.BuildErrorReq
-		payload     = c.PostForm("payload")
-		buf         = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
-	if err != nil {
+	if err := p.call(c, origin, jobDone); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
+	p.jobs.done(jobDoneReq.ID)
+}
 
-	if err := d.Decode(&buildErrReq); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+func (p *proxy) reportBuildError(c *gin.Context, client, key string) {
+	var buildErrReq dashapi.BuildErrorReq
+	if err := decode(c, &buildErrReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	if err := r.Close(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	if !p.allow(c, client, buildErrReq.Build.Manager, "report_build_error") {
 		return
 	}
+	build := &buildErrReq.Build
+	p.metrics.buildErrorCounters.WithLabelValues(build.Manager, build.ID, build.OS, build.Arch, build.VMArch).Inc()
 
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		err := dash.ReportBuildError(&buildErrReq)
-		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-			return
-		}
-	}
-	p.dashMu.RUnlock()
+	p.write(c, "report_build_error", func(dash *dashapi.Dashboard) error {
+		return dash.ReportBuildError(rewrite(p, dash, "report_build_error", &buildErrReq))
+	})
 }
 
 func (p *proxy) commitPoll(c *gin.Context, client, key string) {
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		_, err := dash.CommitPoll()
+	if !p.allow(c, client, "", "commit_poll") {
+		return
+	}
+	gen, ok := p.cached(c, "commit_poll", "")
+	if ok {
+		return
+	}
+	// syz-ci polls the commits of a single dashboard, so only the primary
+	// upstream is polled.
+	resp := &dashapi.CommitPollResp{}
+	if len(p.order) != 0 {
+		p.dashMu.RLock()
+		err := p.call(c, p.order[0], func(dash *dashapi.Dashboard) error {
+			var err error
+			resp, err = dash.CommitPoll()
+			return err
+		})
+		p.dashMu.RUnlock()
+		p.offline.reachable(err == nil || !transient(err))
 		if err != nil {
-			p.dashMu.RUnlock()
+			if transient(err) && p.offlineDefault(c, "commit_poll", &dashapi.CommitPollResp{
+				ReportEmail: p.offline.conf.ReportEmail,
+			}) {
+				return
+			}
 			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
 			return
 		}
 	}
-	p.dashMu.RUnlock()
+	p.cache.put("commit_poll", "", gen, resp)
+	c.JSON(http.StatusOK, resp)
 }
 
 func (p *proxy) uploadCommits(c *gin.Context, client, key string) {
-	var (
-		req     dashapi.CommitPollResultReq
-		payload = c.PostForm("payload")
-		buf     = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-		return
-	}
-	d := json.NewDecoder(r)
-
-	if err := d.Decode(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	var req dashapi.CommitPollResultReq
+	if err := decode(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	if err := r.Close(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	if !p.allow(c, client, "", "upload_commits") {
 		return
 	}
 
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		err := dash.UploadCommits(req.Commits)
-		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-			return
-		}
-	}
-	p.dashMu.RUnlock()
+	p.write(c, "upload_commits", func(dash *dashapi.Dashboard) error {
+		return dash.UploadCommits(rewrite(p, dash, "upload_commits", &req).Commits)
+	})
 }
 
 func (p *proxy) reportCrash(c *gin.Context, client, key string) {
-	var (
-		req     dashapi.Crash
-		payload = c.PostForm("payload")
-		buf     = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	var req dashapi.Crash
+	if err := decode(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
-
-	if err := d.Decode(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	manager := p.builds.manager(req.BuildID)
+	if !p.allow(c, client, manager, "report_crash") {
 		return
 	}
-
-	if err := r.Close(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-		return
-	}
-
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		_, err := dash.ReportCrash(&req)
-		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	rule := p.matchCrash(req.Title, manager)
+	if rule != nil {
+		p.metrics.crashRuleCounters.WithLabelValues(rule.Name, rule.Action).Inc()
+		log := p.logger(c).With("rule", rule.Name, "title", req.Title, "manager", manager)
+		switch rule.Action {
+		case CrashDrop:
+			log.Debug("crash dropped")
+			c.JSON(http.StatusOK, &dashapi.ReportCrashResp{})
+			return
+		case CrashLocal:
+			log.Info("crash kept locally")
+			p.localCrashes.add(rule.Name, manager, &req)
+			c.JSON(http.StatusOK, &dashapi.ReportCrashResp{})
 			return
+		case CrashDowngrade:
+			log.Debug("crash downgraded")
+			req.Corrupted = true
+			req.ReproOpts, req.ReproSyz, req.ReproC = nil, nil, nil
 		}
 	}
-	p.dashMu.RUnlock()
+	if len(req.ReproSyz) != 0 || len(req.ReproC) != 0 {
+		p.reproBudget.end(req.Title, manager)
+	}
+
+	resps, outcome := mirror(p, c, "report_crash", func(dash *dashapi.Dashboard) (*dashapi.ReportCrashResp, error) {
+		return dash.ReportCrash(rewrite(p, dash, "report_crash", &req))
+	})
+	// The upstreams that accepted the crash vote on its reproduction and
+	// repro rules override them like for need_repro, downgraded crashes
+	// are never reproduced.
+	votes := map[string]bool{}
+	for addr, resp := range resps {
+		votes[addr] = resp.NeedRepro
+	}
+	needRepro, _ := p.decideRepro(votes)
+	if r := p.matchRepro(req.Title, manager); r != nil {
+		needRepro = r.NeedRepro
+	}
+	if rule != nil {
+		needRepro = false
+	}
+	if needRepro {
+		needRepro = p.reproBudget.start(req.Title, manager)
+	}
+	respondWrite(c, outcome, gin.H{"NeedRepro": needRepro})
 }
 
 func (p *proxy) needRepro(c *gin.Context, client, key string) {
-	var (
-		req     dashapi.CrashID
-		payload = c.PostForm("payload")
-		buf     = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	var req dashapi.CrashID
+	if err := decode(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
-
-	if err := d.Decode(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	manager := p.builds.manager(req.BuildID)
+	if !p.allow(c, client, manager, "need_repro") {
+		return
+	}
+	// Crashes matching a rule are never reproduced.
+	if rule := p.matchCrash(req.Title, manager); rule != nil {
+		c.JSON(http.StatusOK, &dashapi.NeedReproResp{})
 		return
 	}
 
-	if err := r.Close(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	if rule := p.matchRepro(req.Title, manager); rule != nil {
+		needRepro := rule.NeedRepro && p.reproBudget.start(req.Title, manager)
+		c.JSON(http.StatusOK, &dashapi.NeedReproResp{NeedRepro: needRepro})
 		return
 	}
 
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		_, err := dash.NeedRepro(&req)
-		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	votes, err := gather(p, c, func(dash *dashapi.Dashboard) (bool, error) {
+		return dash.NeedRepro(rewrite(p, dash, "need_repro", &req))
+	})
+	if err != nil {
+		if transient(err) && p.offline.conf.Enabled {
+			needRepro := p.offline.conf.NeedRepro && p.reproBudget.start(req.Title, manager)
+			p.offlineDefault(c, "need_repro", &dashapi.NeedReproResp{NeedRepro: needRepro})
 			return
 		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+		return
 	}
-	p.dashMu.RUnlock()
-}
-
-func (p *proxy) reportFailedRepro(c *gin.Context, client, key string) {
-	var (
-		req     dashapi.CrashID
-		payload = c.PostForm("payload")
-		buf     = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
+	needRepro, err := p.decideRepro(votes)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
+	if needRepro && !p.reproBudget.start(req.Title, manager) {
+		p.logger(c).Info("repro budget exhausted", "title", req.Title, "manager", manager)
+		needRepro = false
+	}
+	c.JSON(http.StatusOK, &dashapi.NeedReproResp{NeedRepro: needRepro})
+}
 
-	if err := d.Decode(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+func (p *proxy) reportFailedRepro(c *gin.Context, client, key string) {
+	var req dashapi.CrashID
+	if err := decode(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	if err := r.Close(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	manager := p.builds.manager(req.BuildID)
+	if !p.allow(c, client, manager, "report_failed_repro") {
 		return
 	}
+	p.reproBudget.end(req.Title, manager)
 
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		err := dash.ReportFailedRepro(&req)
-		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-			return
-		}
-	}
-	p.dashMu.RUnlock()
+	p.write(c, "report_failed_repro", func(dash *dashapi.Dashboard) error {
+		return dash.ReportFailedRepro(rewrite(p, dash, "report_failed_repro", &req))
+	})
 }
 
 func (p *proxy) logError(c *gin.Context, client, key string) {
-	var (
-		req     dashapi.LogEntry
-		payload = c.PostForm("payload")
-		buf     = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	var req dashapi.LogEntry
+	if err := decode(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
-
-	if err := d.Decode(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-		return
-	}
-
-	if err := r.Close(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	if !p.allow(c, client, "", "log_error") {
 		return
 	}
 
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		dash.LogError(req.Name, req.Text)
-	}
-	p.dashMu.RUnlock()
+	// LogError does not report errors so it always succeeds.
+	p.write(c, "log_error", func(dash *dashapi.Dashboard) error {
+		req := rewrite(p, dash, "log_error", &req)
+		dash.LogError(req.Name, "%s", req.Text)
+		return nil
+	})
 }
 
 func (p *proxy) reportingPollBugs(c *gin.Context, client, key string) {
-	var (
-		req     dashapi.PollBugsRequest
-		payload = c.PostForm("payload")
-		buf     = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	var req dashapi.PollBugsRequest
+	if err := decode(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
-
-	if err := d.Decode(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	if !p.allow(c, client, "", "reporting_poll_bugs") {
 		return
 	}
 
-	if err := r.Close(); err != nil {
+	resps, err := gather(p, c, func(dash *dashapi.Dashboard) (*dashapi.PollBugsResponse, error) {
+		return dash.ReportingPollBugs(rewrite(p, dash, "reporting_poll_bugs", &req).Type)
+	})
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
 		return
 	}
-
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		_, err := dash.ReportingPollBugs(req.Type)
-		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-			return
-		}
-	}
-	p.dashMu.RUnlock()
+	c.JSON(http.StatusOK, gin.H{"Reports": p.mergePollBugs(resps)})
 }
 
 func (p *proxy) reportingPollNotifs(c *gin.Context, client, key string) {
-	var (
-		req     dashapi.PollNotificationsRequest
-		payload = c.PostForm("payload")
-		buf     = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	var req dashapi.PollNotificationsRequest
+	if err := decode(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
-
-	if err := d.Decode(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	if !p.allow(c, client, "", "reporting_poll_notifs") {
 		return
 	}
 
-	if err := r.Close(); err != nil {
+	if err := p.forward(c, func(dash *dashapi.Dashboard) error {
+		_, err := dash.ReportingPollNotifications(rewrite(p, dash, "reporting_poll_notifs", &req).Type)
+		return err
+	}); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
 		return
 	}
-
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		_, err := dash.ReportingPollNotifications(req.Type)
-		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-			return
-		}
-	}
-	p.dashMu.RUnlock()
 }
 
 func (p *proxy) reportingPollClosed(c *gin.Context, client, key string) {
-	var (
-		req     dashapi.PollClosedRequest
-		payload = c.PostForm("payload")
-		buf     = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	var req dashapi.PollClosedRequest
+	if err := decode(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
-
-	if err := d.Decode(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	if !p.allow(c, client, "", "reporting_poll_closed") {
 		return
 	}
 
-	if err := r.Close(); err != nil {
+	if err := p.forward(c, func(dash *dashapi.Dashboard) error {
+		_, err := dash.ReportingPollClosed(rewrite(p, dash, "reporting_poll_closed", &req).IDs)
+		return err
+	}); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
 		return
 	}
-
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		_, err := dash.ReportingPollClosed(req.IDs)
-		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-			return
-		}
-	}
-	p.dashMu.RUnlock()
 }
 
 func (p *proxy) reportingUpdate(c *gin.Context, client, key string) {
-	var (
-		req     dashapi.BugUpdate
-		payload = c.PostForm("payload")
-		buf     = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	var req dashapi.BugUpdate
+	if err := decode(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
-
-	if err := d.Decode(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	if !p.allow(c, client, "", "reporting_update") {
 		return
 	}
+	defer p.cache.invalidate("reporting_update")
 
-	if err := r.Close(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-		return
+	update := func(dash *dashapi.Dashboard) (*dashapi.BugUpdateReply, error) {
+		return dash.ReportingUpdate(rewrite(p, dash, "reporting_update", &req))
 	}
-
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		_, err := dash.ReportingUpdate(&req)
-		if err != nil {
-			p.dashMu.RUnlock()
+	// Bugs are only known to the upstream that reported them.
+	if origin, ok := p.bugOrigins.get(req.ID); ok {
+		var reply *dashapi.BugUpdateReply
+		if err := p.call(c, origin, func(dash *dashapi.Dashboard) error {
+			var err error
+			reply, err = update(dash)
+			return err
+		}); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
 			return
 		}
+		c.JSON(http.StatusOK, reply)
+		return
 	}
-	p.dashMu.RUnlock()
-}
-
-func (p *proxy) managerStats(c *gin.Context, client, key string) {
-	var (
-		req     dashapi.ManagerStatsReq
-		payload = c.PostForm("payload")
-		buf     = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
+	p.logger(c).Warn("bug upstream unknown", "bug", req.ID)
+	replies, err := gather(p, c, update)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
+	c.JSON(http.StatusOK, p.mergeUpdateReplies(replies))
+}
 
-	if err := d.Decode(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+func (p *proxy) managerStats(c *gin.Context, client, key string) {
+	var req dashapi.ManagerStatsReq
+	if err := decode(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	if err := r.Close(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	if !p.allow(c, client, req.Name, "manager_stats") {
 		return
 	}
 
-	managerUptimeGauges.WithLabelValues(req.Name).Set(float64(req.UpTime))
-	managerCorpusGauges.WithLabelValues(req.Name).Set(float64(req.Corpus))
-	managerPCsGauges.WithLabelValues(req.Name).Set(float64(req.PCs))
-	managerCoverageGauges.WithLabelValues(req.Name).Set(float64(req.Cover))
-	managerCrashesCounters.WithLabelValues(req.Name).Add(float64(req.Crashes))
-	managerExecsCounters.WithLabelValues(req.Name).Add(float64(req.Execs))
-	managerSuppCrashesCounters.WithLabelValues(req.Name).Add(float64(req.SuppressedCrashes))
-	managerFuzzingDurCounters.WithLabelValues(req.Name).Add(float64(req.FuzzingTime))
-
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		err := dash.UploadManagerStats(&req)
-		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-			return
-		}
+	if p.managers.stats(client, &req) {
+		p.metrics.managerDuplicateStatsCounters.WithLabelValues(req.Name).Inc()
+		p.logger(c).Debug("duplicate manager stats ignored", "manager", req.Name)
+		c.JSON(http.StatusOK, gin.H{})
+		return
+	}
+	_, outcome := mirror(p, c, "manager_stats", func(dash *dashapi.Dashboard) (struct{}, error) {
+		return struct{}{}, dash.UploadManagerStats(rewrite(p, dash, "manager_stats", &req))
+	})
+	defer respondWrite(c, outcome, gin.H{})
+	if !outcome.OK {
+		return
 	}
-	p.dashMu.RUnlock()
+	// Crashes, execs and fuzzing time are deltas since the last accepted
+	// upload so they add up across manager restarts, the manager sends
+	// them again when the upload fails.
+	if elapsed := p.managers.accepted(&req); elapsed > 0 {
+		p.metrics.managerExecRateGauges.WithLabelValues(req.Name).Set(float64(req.Execs) / elapsed.Seconds())
+		p.metrics.managerCrashRateGauges.WithLabelValues(req.Name).Set(float64(req.Crashes) / elapsed.Hours())
+	}
+	p.history.add(&req)
+	p.anomalies.add(&req)
+	p.metrics.managerUptimeGauges.WithLabelValues(req.Name).Set(float64(req.UpTime))
+	p.metrics.managerCorpusGauges.WithLabelValues(req.Name).Set(float64(req.Corpus))
+	p.metrics.managerPCsGauges.WithLabelValues(req.Name).Set(float64(req.PCs))
+	p.metrics.managerCoverageGauges.WithLabelValues(req.Name).Set(float64(req.Cover))
+	p.metrics.managerCrashesCounters.WithLabelValues(req.Name).Add(float64(req.Crashes))
+	p.metrics.managerExecsCounters.WithLabelValues(req.Name).Add(float64(req.Execs))
+	p.metrics.managerSuppCrashesCounters.WithLabelValues(req.Name).Add(float64(req.SuppressedCrashes))
+	p.metrics.managerFuzzingDurCounters.WithLabelValues(req.Name).Add(float64(req.FuzzingTime))
 }
 
 func (p *proxy) bugList(c *gin.Context, client, key string) {
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		_, err := dash.BugList()
-		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
-			return
-		}
-
+	if !p.allow(c, client, "", "bug_list") {
+		return
 	}
-	p.dashMu.RUnlock()
-}
-
-func (p *proxy) loadBug(c *gin.Context, client, key string) {
-	var (
-		req     dashapi.LoadBugReq
-		payload = c.PostForm("payload")
-		buf     = bytes.NewBufferString(payload)
-	)
-	r, err := gzip.NewReader(buf)
+	gen, ok := p.cached(c, "bug_list", "")
+	if ok {
+		return
+	}
+	resps, err := gather(p, c, func(dash *dashapi.Dashboard) (*dashapi.BugListResp, error) {
+		return dash.BugList()
+	})
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
 		return
 	}
-	d := json.NewDecoder(r)
+	merged := p.mergeBugList(resps)
+	p.cache.put("bug_list", "", gen, merged)
+	c.JSON(http.StatusOK, merged)
+}
 
-	if err := d.Decode(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+func (p *proxy) loadBug(c *gin.Context, client, key string) {
+	var req dashapi.LoadBugReq
+	if err := decode(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	if err := r.Close(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	if !p.allow(c, client, "", "load_bug") {
+		return
+	}
+	reqKey := cacheKey(&req)
+	gen, ok := p.cached(c, "load_bug", reqKey)
+	if ok {
 		return
 	}
 
-	p.dashMu.RLock()
-	for _, dash := range p.dashes {
-		_, err := dash.LoadBug(req.ID)
-		if err != nil {
-			p.dashMu.RUnlock()
-			c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
+	// Bugs are only known to one upstream, the first one that has it wins.
+	for _, addr := range p.bugUpstreams(req.ID) {
+		var resp *dashapi.LoadBugResp
+		if err := p.call(c, addr, func(dash *dashapi.Dashboard) error {
+			var err error
+			resp, err = dash.LoadBug(rewrite(p, dash, "load_bug", &req).ID)
+			return err
+		}); err == nil {
+			p.bugOrigins.set(req.ID, addr)
+			p.cache.put("load_bug", reqKey, gen, resp)
+			c.JSON(http.StatusOK, resp)
 			return
 		}
 	}
-	p.dashMu.RUnlock()
+	c.JSON(http.StatusBadRequest, gin.H{"error": errUnknownMethod.Error()})
 }
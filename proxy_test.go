@@ -0,0 +1,213 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/syzkaller/dashboard/dashapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeDashboard is an upstream dashboard that answers every call with a
+// status and a json answer per method, an empty object by default. It keeps
+// the payloads it received by method.
+type fakeDashboard struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	status    int
+	calls     int
+	responses map[string]string
+	received  map[string][]string
+	// hold, if set, holds the answers until it is closed.
+	hold chan struct{}
+}
+
+func newFakeDashboard(t *testing.T) *fakeDashboard {
+	d := &fakeDashboard{
+		status:    http.StatusOK,
+		responses: map[string]string{},
+		received:  map[string][]string{},
+	}
+	d.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.calls++
+		if hold := d.hold; hold != nil {
+			d.mu.Unlock()
+			<-hold
+			d.mu.Lock()
+		}
+		if d.status != http.StatusOK {
+			http.Error(w, "failed", d.status)
+			return
+		}
+		method := r.PostFormValue("method")
+		if gz, err := gzip.NewReader(strings.NewReader(r.PostFormValue("payload"))); err == nil {
+			payload, _ := io.ReadAll(gz)
+			d.received[method] = append(d.received[method], string(payload))
+		}
+		resp, ok := d.responses[method]
+		if !ok {
+			resp = "{}"
+		}
+		w.Write([]byte(resp))
+	}))
+	t.Cleanup(d.Close)
+	return d
+}
+
+func (d *fakeDashboard) setResponse(method, resp string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.responses[method] = resp
+}
+
+// payloads returns the payloads of the calls of a method.
+func (d *fakeDashboard) payloads(method string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.received[method]...)
+}
+
+// called returns the number of calls the upstream got.
+func (d *fakeDashboard) called() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls
+}
+
+func (d *fakeDashboard) setStatus(status int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status = status
+}
+
+// newTestProxy serves a proxy for upstreams and returns it with a client.
+func newTestProxy(t *testing.T, conf *Config, upstreams ...*fakeDashboard) (*proxy, *dashapi.Dashboard) {
+	gin.SetMode(gin.TestMode)
+	var forward []string
+	for _, u := range upstreams {
+		forward = append(forward, u.URL)
+	}
+	p, err := New(forward, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	r := gin.New()
+	r.POST("/api", p.Proxy)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return p.(*proxy), dashapi.New("client", srv.URL, "key")
+}
+
+func TestManagerStatsResend(t *testing.T) {
+	upstream := newFakeDashboard(t)
+	p, client := newTestProxy(t, nil, upstream)
+
+	upload := func(req *dashapi.ManagerStatsReq) error {
+		return client.UploadManagerStats(req)
+	}
+	if err := upload(&dashapi.ManagerStatsReq{Name: "m", UpTime: time.Minute, Execs: 60, Crashes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// The upstream fails the next upload, the manager keeps its deltas and
+	// sends them again with the next one.
+	upstream.setStatus(http.StatusBadGateway)
+	if err := upload(&dashapi.ManagerStatsReq{Name: "m", UpTime: 2 * time.Minute, Execs: 120, Crashes: 2}); err == nil {
+		t.Fatal("failed upload succeeded")
+	}
+	upstream.setStatus(http.StatusOK)
+	if err := upload(&dashapi.ManagerStatsReq{Name: "m", UpTime: 3 * time.Minute, Execs: 300, Crashes: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// The last upload repeats the last accepted one.
+	if err := upload(&dashapi.ManagerStatsReq{Name: "m", UpTime: 3 * time.Minute, Execs: 300, Crashes: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"execs", testutil.ToFloat64(p.metrics.managerExecsCounters.WithLabelValues("m")), 360},
+		{"crashes", testutil.ToFloat64(p.metrics.managerCrashesCounters.WithLabelValues("m")), 4},
+		{"execs per second", testutil.ToFloat64(p.metrics.managerExecRateGauges.WithLabelValues("m")), 2.5},
+		{"duplicates", testutil.ToFloat64(p.metrics.managerDuplicateStatsCounters.WithLabelValues("m")), 1},
+		{"restarts", testutil.ToFloat64(p.metrics.managerRestartCounters.WithLabelValues("m")), 0},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestCommitPollPrimary(t *testing.T) {
+	primary, secondary := newFakeDashboard(t), newFakeDashboard(t)
+	secondary.setStatus(http.StatusServiceUnavailable)
+	_, client := newTestProxy(t, nil, primary, secondary)
+
+	if _, err := client.CommitPoll(); err != nil {
+		t.Fatal(err)
+	}
+	secondary.mu.Lock()
+	defer secondary.mu.Unlock()
+	if secondary.calls != 0 {
+		t.Errorf("secondary polled %v times, want 0", secondary.calls)
+	}
+}
+
+func TestClose(t *testing.T) {
+	upstream := newFakeDashboard(t)
+	before := runtime.NumGoroutine()
+	p, err := New([]string{upstream.URL}, &Config{
+		StateDir: t.TempDir(),
+		Offline:  OfflineConfig{Enabled: true},
+		History:  HistoryConfig{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		p.Close()
+		p.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close did not stop the background loops")
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("got %v goroutines after close, want %v", n, before)
+	}
+	if _, err := os.Stat(p.(*proxy).snapshotPath); err != nil {
+		t.Errorf("metrics not saved on close: %v", err)
+	}
+}
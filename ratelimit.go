@@ -0,0 +1,220 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+var (
+	errRateLimited = errors.New("rate limit exceeded")
+)
+
+// RateLimit is a token bucket limit on API calls.
+type RateLimit struct {
+	// Client, Manager and Method select the requests the limit applies
+	// to, an empty value matches everything.
+	Client  string `yaml:"client"`
+	Manager string `yaml:"manager"`
+	Method  string `yaml:"method"`
+	// By lists the request attributes (client, manager or method) that
+	// get a bucket of their own, by default all matching requests share a
+	// single bucket.
+	By []string `yaml:"by"`
+	// Rate is the number of requests per second and Burst the size of the
+	// bucket, which defaults to the rate rounded up.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// keys returns the buckets of the limit a request takes a token from, one
+// per manager when the limit is on managers. Limits on managers do not apply
+// to requests whose manager is unknown.
+func (l RateLimit) keys(i int, client, method string, managers []string) []string {
+	if l.Client != "" && l.Client != client || l.Method != "" && l.Method != method {
+		return nil
+	}
+	byManager := l.Manager != ""
+	for _, by := range l.By {
+		byManager = byManager || by == "manager"
+	}
+	if !byManager {
+		return []string{l.key(i, client, "", method)}
+	}
+	var (
+		keys []string
+		seen = map[string]bool{}
+	)
+	for _, manager := range managers {
+		if manager == "" || l.Manager != "" && l.Manager != manager {
+			continue
+		}
+		key := l.key(i, client, manager, method)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (l RateLimit) key(i int, client, manager, method string) string {
+	key := []string{strconv.Itoa(i)}
+	for _, by := range l.By {
+		switch by {
+		case "client":
+			key = append(key, client)
+		case "manager":
+			key = append(key, manager)
+		case "method":
+			key = append(key, method)
+		}
+	}
+	return strings.Join(key, "\x00")
+}
+
+// bucketSweepInterval is how often idle buckets are removed at most.
+const bucketSweepInterval = time.Minute
+
+// bucket is the token bucket of a limit for a client, manager or method.
+type bucket struct {
+	*rate.Limiter
+	// refill is how long the bucket takes to fill up from empty, a bucket
+	// that was not used for longer is full and can be removed.
+	refill time.Duration
+	used   time.Time
+}
+
+type rateLimiter struct {
+	limits []RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newRateLimiter(limits []RateLimit) (*rateLimiter, error) {
+	for i, l := range limits {
+		if l.Rate <= 0 {
+			return nil, fmt.Errorf("rate limit %d: rate must be positive", i)
+		}
+		if l.Burst <= 0 {
+			limits[i].Burst = int(math.Ceil(l.Rate))
+		}
+		for _, by := range l.By {
+			switch by {
+			case "client", "manager", "method":
+			default:
+				return nil, fmt.Errorf("rate limit %d: unknown attribute %q", i, by)
+			}
+		}
+	}
+	return &rateLimiter{
+		limits:  limits,
+		buckets: map[string]*bucket{},
+		swept:   time.Now(),
+	}, nil
+}
+
+// delay returns how long a request of some managers has to wait before every
+// matching limit allows it, a request that is delayed does not consume any
+// tokens.
+func (r *rateLimiter) delay(client string, managers []string, method string) time.Duration {
+	var (
+		now          = time.Now()
+		delay        time.Duration
+		reservations []*rate.Reservation
+	)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweep(now)
+	for i, l := range r.limits {
+		for _, key := range l.keys(i, client, method, managers) {
+			b, ok := r.buckets[key]
+			if !ok {
+				b = &bucket{
+					Limiter: rate.NewLimiter(rate.Limit(l.Rate), l.Burst),
+					refill:  time.Duration(float64(l.Burst) / l.Rate * float64(time.Second)),
+				}
+				r.buckets[key] = b
+			}
+			b.used = now
+			res := b.ReserveN(now, 1)
+			reservations = append(reservations, res)
+			if d := res.DelayFrom(now); d > delay {
+				delay = d
+			}
+		}
+	}
+	if delay > 0 {
+		for _, res := range reservations {
+			res.CancelAt(now)
+		}
+	}
+	return delay
+}
+
+// sweep removes the buckets that are full again, clients and managers come
+// and go and a new bucket for them starts out full anyway. The caller must
+// hold the lock.
+func (r *rateLimiter) sweep(now time.Time) {
+	if now.Sub(r.swept) < bucketSweepInterval {
+		return
+	}
+	r.swept = now
+	for key, b := range r.buckets {
+		if now.Sub(b.used) > b.refill {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// allow checks the rate limits of a request and responds with a retryable
+// error when they are exceeded, the manager is empty when it is unknown.
+func (p *proxy) allow(c *gin.Context, client, manager, method string) bool {
+	return p.allowManagers(c, client, []string{manager}, method)
+}
+
+// allowManagers is allow for a request made on behalf of several managers.
+func (p *proxy) allowManagers(c *gin.Context, client string, managers []string, method string) bool {
+	manager := strings.Join(managers, ",")
+	trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.String("syz.manager", manager))
+	delay := p.limiter.delay(client, managers, method)
+	if delay == 0 {
+		return true
+	}
+	if len(managers) == 0 {
+		p.metrics.throttledCounters.WithLabelValues(client, "", method).Inc()
+	}
+	for _, manager := range managers {
+		p.metrics.throttledCounters.WithLabelValues(client, manager, method).Inc()
+	}
+	p.logger(c).Warn("rate limited", "manager", manager, "retry_after", delay)
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": errRateLimited.Error()})
+	return false
+}
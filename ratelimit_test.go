@@ -0,0 +1,60 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	r, err := newRateLimiter([]RateLimit{
+		{Method: "job_poll", By: []string{"manager"}, Rate: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		managers []string
+		method   string
+		limited  bool
+	}{
+		{[]string{"m1"}, "job_poll", false},
+		{[]string{"m1"}, "job_poll", true},
+		{[]string{"m2"}, "job_poll", false},
+		{[]string{"m1"}, "builder_poll", false},
+		// Requests of unknown managers are not limited per manager.
+		{[]string{""}, "job_poll", false},
+		{[]string{""}, "job_poll", false},
+		// A delayed request does not take tokens from any bucket.
+		{[]string{"m3", "m2"}, "job_poll", true},
+		{[]string{"m3"}, "job_poll", false},
+	} {
+		if limited := r.delay("client", test.managers, test.method) > 0; limited != test.limited {
+			t.Errorf("%v %v: got limited %v, want %v", test.managers, test.method, limited, test.limited)
+		}
+	}
+
+	// Buckets that are full again are removed.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.buckets) != 3 {
+		t.Errorf("got %v buckets, want 3", len(r.buckets))
+	}
+	r.sweep(time.Now().Add(bucketSweepInterval))
+	if len(r.buckets) != 0 {
+		t.Errorf("got %v buckets after a sweep, want 0", len(r.buckets))
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// need_repro policies.
+const (
+	// ReproPrimary follows the answer of the primary upstream.
+	ReproPrimary = "primary"
+	// ReproAny reproduces crashes that any upstream needs a repro for.
+	ReproAny = "any"
+	// ReproAll reproduces crashes that every upstream that answered needs
+	// a repro for.
+	ReproAll = "all"
+)
+
+var (
+	errNoPrimary = errors.New("primary upstream failed")
+)
+
+// ReproConfig configures how need_repro is answered.
+type ReproConfig struct {
+	// Policy combines the answers of the upstreams: primary, any (the
+	// default) or all.
+	Policy string `yaml:"policy"`
+	// Rules override the upstreams, the first matching rule wins.
+	Rules []*ReproRule `yaml:"rules"`
+}
+
+func (conf *ReproConfig) validate(upstreams int) error {
+	switch conf.Policy {
+	case "":
+		conf.Policy = ReproAny
+	case ReproPrimary:
+		if upstreams == 0 {
+			return fmt.Errorf("need_repro policy primary without upstreams")
+		}
+	case ReproAny, ReproAll:
+	default:
+		return fmt.Errorf("unknown need_repro policy %q", conf.Policy)
+	}
+	for _, r := range conf.Rules {
+		if err := r.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReproRule decides if crashes need a reproducer.
+type ReproRule struct {
+	// Title and Manager are regexps matched against the crash title and
+	// the manager of the crash, an empty regexp matches everything. Rules
+	// on managers do not match crashes whose manager is unknown.
+	Title     string `yaml:"title"`
+	Manager   string `yaml:"manager"`
+	NeedRepro bool   `yaml:"need_repro"`
+
+	title   *regexp.Regexp
+	manager *regexp.Regexp
+}
+
+func (r *ReproRule) compile() error {
+	var err error
+	if r.title, err = regexp.Compile(r.Title); err != nil {
+		return fmt.Errorf("need_repro rule: %v", err)
+	}
+	if r.manager, err = regexp.Compile(r.Manager); err != nil {
+		return fmt.Errorf("need_repro rule: %v", err)
+	}
+	return nil
+}
+
+// matchRepro returns the first repro rule that matches a crash, if any.
+func (p *proxy) matchRepro(title, manager string) *ReproRule {
+	for _, r := range p.repro.Rules {
+		if r.title.MatchString(title) && matchManager(r.Manager, r.manager, manager) {
+			return r
+		}
+	}
+	return nil
+}
+
+// decideRepro combines the need_repro votes of the upstreams that answered
+// according to the policy.
+func (p *proxy) decideRepro(votes map[string]bool) (bool, error) {
+	for addr, vote := range votes {
+		p.metrics.reproVoteCounters.WithLabelValues(addr, fmt.Sprint(vote)).Inc()
+	}
+	switch p.repro.Policy {
+	case ReproPrimary:
+		vote, ok := votes[p.order[0]]
+		if !ok {
+			return false, errNoPrimary
+		}
+		return vote, nil
+	case ReproAll:
+		for _, vote := range votes {
+			if !vote {
+				return false, nil
+			}
+		}
+		return len(votes) > 0, nil
+	default:
+		for _, vote := range votes {
+			if vote {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReproBudgetConfig limits reproduction attempts, a zero limit is unlimited.
+type ReproBudgetConfig struct {
+	// Window is the period attempts are counted over.
+	Window time.Duration `yaml:"window"`
+	// PerTitle is the number of attempts per crash title in a window.
+	PerTitle int `yaml:"per_title"`
+	// PerManager is the number of attempts per manager in a window.
+	PerManager int `yaml:"per_manager"`
+}
+
+// reproAttempt is a reproduction attempt of a crash.
+type reproAttempt struct {
+	title   string
+	manager string
+	time    time.Time
+}
+
+// reproBudget tracks reproduction attempts. An attempt starts when
+// need_repro says yes and ends with report_failed_repro or a crash with a
+// reproducer, attempts the proxy did not grant are counted when they end.
+type reproBudget struct {
+	conf    ReproBudgetConfig
+	metrics *metrics
+
+	mu       sync.Mutex
+	attempts []reproAttempt
+	// granted holds the start of attempts that did not end yet by title
+	// and manager.
+	granted map[[2]string][]time.Time
+}
+
+func newReproBudget(conf ReproBudgetConfig, m *metrics) *reproBudget {
+	return &reproBudget{
+		conf:    conf,
+		metrics: m,
+		granted: map[[2]string][]time.Time{},
+	}
+}
+
+func (b *reproBudget) enabled() bool {
+	return b.conf.Window > 0 && (b.conf.PerTitle > 0 || b.conf.PerManager > 0)
+}
+
+// start records the start of an attempt if the budget allows it.
+func (b *reproBudget) start(title, manager string) bool {
+	if !b.enabled() {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire()
+	titles, managers := b.counts()
+	if b.conf.PerTitle > 0 && titles[title] >= b.conf.PerTitle ||
+		b.conf.PerManager > 0 && manager != "" && managers[manager] >= b.conf.PerManager {
+		b.metrics.reproBudgetDeniedCounters.WithLabelValues(manager).Inc()
+		return false
+	}
+	now := time.Now()
+	b.attempts = append(b.attempts, reproAttempt{title, manager, now})
+	key := [2]string{title, manager}
+	b.granted[key] = append(b.granted[key], now)
+	b.update()
+	return true
+}
+
+// end records the end of an attempt.
+func (b *reproBudget) end(title, manager string) {
+	if !b.enabled() {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire()
+	key := [2]string{title, manager}
+	if granted := b.granted[key]; len(granted) > 0 {
+		b.granted[key] = granted[1:]
+		return
+	}
+	b.attempts = append(b.attempts, reproAttempt{title, manager, time.Now()})
+	b.update()
+}
+
+// expire forgets attempts that are out of the window.
+func (b *reproBudget) expire() {
+	cutoff := time.Now().Add(-b.conf.Window)
+	attempts := b.attempts[:0]
+	for _, a := range b.attempts {
+		if a.time.After(cutoff) {
+			attempts = append(attempts, a)
+		}
+	}
+	b.attempts = attempts
+	for key, granted := range b.granted {
+		for len(granted) > 0 && !granted[0].After(cutoff) {
+			granted = granted[1:]
+		}
+		if len(granted) == 0 {
+			delete(b.granted, key)
+			continue
+		}
+		b.granted[key] = granted
+	}
+}
+
+// counts returns the attempts in the window by title and by manager,
+// attempts of unknown managers only count for their title.
+func (b *reproBudget) counts() (map[string]int, map[string]int) {
+	titles, managers := map[string]int{}, map[string]int{}
+	for _, a := range b.attempts {
+		titles[a.title]++
+		if a.manager != "" {
+			managers[a.manager]++
+		}
+	}
+	return titles, managers
+}
+
+// update updates the budget metrics.
+func (b *reproBudget) update() {
+	_, managers := b.counts()
+	var series []gaugeSeries
+	for manager, n := range managers {
+		series = append(series, gaugeSeries{[]string{manager}, float64(n)})
+	}
+	b.metrics.reproBudgetAttemptsGauges.replace(series)
+}
+
+// reproBudgetUsage is the budget usage of a crash title or manager,
+// remaining attempts are -1 when unlimited.
+type reproBudgetUsage struct {
+	Attempts  int `json:"attempts"`
+	Remaining int `json:"remaining"`
+}
+
+// ReproBudget returns the state of the reproduction budget.
+func (p *proxy) ReproBudget(c *gin.Context) {
+	b := p.reproBudget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire()
+	b.update()
+	var (
+		titles, managers = b.counts()
+		titleUsage       = map[string]reproBudgetUsage{}
+		managerUsage     = map[string]reproBudgetUsage{}
+	)
+	for title, n := range titles {
+		titleUsage[title] = reproBudgetUsage{n, remaining(b.conf.PerTitle, n)}
+	}
+	for manager, n := range managers {
+		managerUsage[manager] = reproBudgetUsage{n, remaining(b.conf.PerManager, n)}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"window":      b.conf.Window.String(),
+		"per_title":   b.conf.PerTitle,
+		"per_manager": b.conf.PerManager,
+		"titles":      titleUsage,
+		"managers":    managerUsage,
+	})
+}
+
+func remaining(limit, n int) int {
+	switch {
+	case limit == 0:
+		return -1
+	case n >= limit:
+		return 0
+	}
+	return limit - n
+}
@@ -0,0 +1,138 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReproBudget(t *testing.T) {
+	// call starts or ends an attempt of a crash title on a manager, ok is
+	// whether a start is granted.
+	type call struct {
+		end     bool
+		title   string
+		manager string
+		ok      bool
+	}
+	for _, test := range []struct {
+		name   string
+		conf   ReproBudgetConfig
+		calls  []call
+		denied map[string]float64
+	}{
+		{
+			name: "per title",
+			conf: ReproBudgetConfig{Window: time.Hour, PerTitle: 2},
+			calls: []call{
+				{title: "a", manager: "m1", ok: true},
+				{title: "a", manager: "m2", ok: true},
+				{title: "a", manager: "m3"},
+				{title: "b", manager: "m3", ok: true},
+			},
+			denied: map[string]float64{"m3": 1},
+		},
+		{
+			name: "per manager",
+			conf: ReproBudgetConfig{Window: time.Hour, PerManager: 1},
+			calls: []call{
+				{title: "a", manager: "m", ok: true},
+				{title: "b", manager: "m"},
+				{title: "b", manager: "n", ok: true},
+				// Unknown managers only count for their title.
+				{title: "c", ok: true},
+				{title: "d", ok: true},
+			},
+			denied: map[string]float64{"m": 1},
+		},
+		{
+			name: "granted attempt ends",
+			conf: ReproBudgetConfig{Window: time.Hour, PerTitle: 2},
+			calls: []call{
+				{title: "a", manager: "m", ok: true},
+				{end: true, title: "a", manager: "m"},
+				{title: "a", manager: "m", ok: true},
+				{title: "a", manager: "m"},
+			},
+			denied: map[string]float64{"m": 1},
+		},
+		{
+			name: "attempt ends without a start",
+			conf: ReproBudgetConfig{Window: time.Hour, PerTitle: 1},
+			calls: []call{
+				{end: true, title: "a", manager: "m"},
+				{title: "a", manager: "m"},
+			},
+			denied: map[string]float64{"m": 1},
+		},
+		{
+			name: "disabled",
+			conf: ReproBudgetConfig{PerTitle: 1},
+			calls: []call{
+				{title: "a", manager: "m", ok: true},
+				{title: "a", manager: "m", ok: true},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := newMetrics(MetricsConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := newReproBudget(test.conf, m)
+			for i, c := range test.calls {
+				if c.end {
+					b.end(c.title, c.manager)
+					continue
+				}
+				if ok := b.start(c.title, c.manager); ok != c.ok {
+					t.Errorf("call %v: start %v on %v got %v, want %v", i, c.title, c.manager, ok, c.ok)
+				}
+			}
+			for manager, want := range test.denied {
+				if got := testutil.ToFloat64(m.reproBudgetDeniedCounters.WithLabelValues(manager)); got != want {
+					t.Errorf("manager %v: got %v denied, want %v", manager, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReproBudgetWindow(t *testing.T) {
+	m, err := newMetrics(MetricsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newReproBudget(ReproBudgetConfig{Window: time.Hour, PerTitle: 1}, m)
+	if !b.start("a", "m") {
+		t.Fatal("first attempt denied")
+	}
+	if b.start("a", "m") {
+		t.Fatal("attempt over the budget granted")
+	}
+	// Attempts out of the window no longer count.
+	for i := range b.attempts {
+		b.attempts[i].time = b.attempts[i].time.Add(-2 * time.Hour)
+	}
+	if !b.start("a", "m") {
+		t.Fatal("attempt after the window denied")
+	}
+	if got := testutil.ToFloat64(m.reproBudgetAttemptsGauges.WithLabelValues("m")); got != 1 {
+		t.Errorf("got %v attempts, want 1", got)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+// Rewrite is a transformation of request payloads forwarded to an upstream.
+type Rewrite struct {
+	// Methods restricts the rule to some API methods, by default it
+	// applies to all of them.
+	Methods []string `yaml:"methods"`
+	// Field is the payload field to rewrite, either a field name that
+	// matches at any depth (KernelRepo) or the end of a path of field
+	// names (Build.KernelRepo).
+	Field string `yaml:"field"`
+	// Strip clears the field.
+	Strip bool `yaml:"strip"`
+	// Prefix is prepended to string values, or to the keys of maps such as
+	// the managers of job_poll.
+	Prefix string `yaml:"prefix"`
+	// Match is a regexp whose matches in string values are replaced with
+	// Replace, which may refer to submatches ($1).
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+
+	match *regexp.Regexp
+}
+
+// compile validates the rule and compiles its regexp.
+func (r *Rewrite) compile() error {
+	if r.Field == "" {
+		return fmt.Errorf("rewrite: missing field")
+	}
+	if r.Match == "" {
+		return nil
+	}
+	re, err := regexp.Compile(r.Match)
+	if err != nil {
+		return fmt.Errorf("rewrite %s: %v", r.Field, err)
+	}
+	r.match = re
+	return nil
+}
+
+func (r *Rewrite) applies(method string) bool {
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rewrite) matches(path string) bool {
+	return path == r.Field || strings.HasSuffix(path, "."+r.Field)
+}
+
+// walk applies the rule to every matching field of v.
+func (r *Rewrite) walk(v reflect.Value, path string) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			r.walk(v.Elem(), path)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			r.walk(v.Index(i), path)
+		}
+	case reflect.Map:
+		// Map values are not addressable, they are rewritten in a copy.
+		iter := v.MapRange()
+		for iter.Next() {
+			elem := reflect.New(iter.Value().Type()).Elem()
+			elem.Set(iter.Value())
+			r.walk(elem, path)
+			v.SetMapIndex(iter.Key(), elem)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			fpath := f.Name
+			if path != "" {
+				fpath = path + "." + f.Name
+			}
+			if r.matches(fpath) {
+				r.rewrite(v.Field(i))
+				continue
+			}
+			r.walk(v.Field(i), fpath)
+		}
+	}
+}
+
+// rewrite transforms a single field value.
+func (r *Rewrite) rewrite(v reflect.Value) {
+	if r.Strip {
+		v.Set(reflect.Zero(v.Type()))
+		return
+	}
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(r.rewriteString(v.String()))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		for i := 0; i < v.Len(); i++ {
+			v.Index(i).SetString(r.rewriteString(v.Index(i).String()))
+		}
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		if r.match != nil {
+			v.SetBytes(r.match.ReplaceAll(v.Bytes(), []byte(r.Replace)))
+		}
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			return
+		}
+		keys := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := reflect.New(v.Type().Key()).Elem()
+			key.SetString(r.rewriteString(iter.Key().String()))
+			keys.SetMapIndex(key, iter.Value())
+		}
+		v.Set(keys)
+	}
+}
+
+func (r *Rewrite) rewriteString(s string) string {
+	if r.match != nil {
+		s = r.match.ReplaceAllString(s, r.Replace)
+	}
+	return r.Prefix + s
+}
+
+// rewrite returns the request as it should be forwarded to an upstream, a
+// rewritten request is a copy and leaves req untouched.
+func rewrite[T any](p *proxy, dash *dashapi.Dashboard, method string, req *T) *T {
+	var rules []*Rewrite
+	for _, r := range p.upstreams[dash.Addr].Rewrite {
+		if r.applies(method) {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return req
+	}
+	// Requests are plain json types so a round trip makes a deep copy.
+	b, err := json.Marshal(req)
+	if err != nil {
+		return req
+	}
+	out := new(T)
+	if err := json.Unmarshal(b, out); err != nil {
+		return req
+	}
+	for _, r := range rules {
+		r.walk(reflect.ValueOf(out), "")
+	}
+	return out
+}
+
+// polledManager returns the manager of a job_poll that an upstream knows by
+// name, as the rewrite rules of the upstream may have renamed the managers
+// the job was polled for.
+func polledManager(p *proxy, dash *dashapi.Dashboard, managers map[string]dashapi.ManagerJobs, name string) string {
+	if _, ok := managers[name]; ok {
+		return name
+	}
+	for manager, jobs := range managers {
+		req := &dashapi.JobPollReq{Managers: map[string]dashapi.ManagerJobs{manager: jobs}}
+		if _, ok := rewrite(p, dash, "job_poll", req).Managers[name]; ok {
+			return manager
+		}
+	}
+	return name
+}
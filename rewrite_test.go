@@ -0,0 +1,87 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"testing"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+func newTestRewriteProxy(t *testing.T, rules ...*Rewrite) (*proxy, *dashapi.Dashboard) {
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := &proxy{upstreams: map[string]UpstreamConfig{"upstream": {Rewrite: rules}}}
+	return p, dashapi.New("client", "upstream", "key")
+}
+
+func TestRewrite(t *testing.T) {
+	p, dash := newTestRewriteProxy(t,
+		&Rewrite{
+			Methods: []string{"upload_build"},
+			Field:   "KernelRepo",
+			Match:   `^https://internal/(.*)$`,
+			Replace: "https://public/$1",
+		},
+		&Rewrite{Field: "Build.KernelConfig", Strip: true},
+		&Rewrite{Field: "Managers", Prefix: "ci-"},
+	)
+
+	build := &dashapi.Build{Manager: "m", KernelRepo: "https://internal/linux.git", KernelConfig: []byte("config")}
+	got := rewrite(p, dash, "upload_build", build)
+	if got.KernelRepo != "https://public/linux.git" {
+		t.Errorf("got kernel repo %q, want it rewritten", got.KernelRepo)
+	}
+	if build.KernelRepo != "https://internal/linux.git" {
+		t.Errorf("original request changed to %q", build.KernelRepo)
+	}
+	// Paths only match the end of the field path and rules only apply to
+	// their methods.
+	if string(got.KernelConfig) != "config" {
+		t.Errorf("got kernel config %q, want it kept", got.KernelConfig)
+	}
+	buildErr := &dashapi.BuildErrorReq{Build: *build}
+	if got := rewrite(p, dash, "report_build_error", buildErr); got.Build.KernelConfig != nil ||
+		got.Build.KernelRepo != build.KernelRepo {
+		t.Errorf("got kernel config %q and repo %q, want config stripped and repo kept",
+			got.Build.KernelConfig, got.Build.KernelRepo)
+	}
+
+	// Managers are renamed in map keys and mapped back in polled jobs.
+	poll := &dashapi.JobPollReq{Managers: map[string]dashapi.ManagerJobs{"m": {TestPatches: true}}}
+	if got := rewrite(p, dash, "job_poll", poll); !got.Managers["ci-m"].TestPatches || len(got.Managers) != 1 {
+		t.Errorf("got managers %v, want ci-m", got.Managers)
+	}
+	if got := polledManager(p, dash, poll.Managers, "ci-m"); got != "m" {
+		t.Errorf("got polled manager %q, want m", got)
+	}
+	if got := polledManager(p, dash, poll.Managers, "other"); got != "other" {
+		t.Errorf("got polled manager %q, want other", got)
+	}
+}
+
+func TestRewriteErrors(t *testing.T) {
+	for _, r := range []*Rewrite{
+		{Prefix: "ci-"},
+		{Field: "KernelRepo", Match: "("},
+	} {
+		if err := r.compile(); err == nil {
+			t.Errorf("invalid rule %+v accepted", r)
+		}
+	}
+}
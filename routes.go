@@ -0,0 +1,183 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// routeSaveInterval is how often routes that were only seen again are saved
+// at most, routes whose upstream changed are saved right away.
+const routeSaveInterval = time.Minute
+
+// route records the upstream that owns an ID and when it was last seen.
+type route struct {
+	Upstream string    `json:"upstream"`
+	Time     time.Time `json:"time"`
+}
+
+// routeStore maps IDs to the upstream that owns them, routes expire after
+// a TTL and are saved to a file when the store has one.
+type routeStore struct {
+	path string
+	ttl  time.Duration
+	log  *slog.Logger
+
+	mu     sync.Mutex
+	routes map[string]route
+	// saved is when the store was last saved.
+	saved time.Time
+}
+
+// newRouteStore returns a route store and loads the routes saved at path.
+func newRouteStore(path string, ttl time.Duration, log *slog.Logger) (*routeStore, error) {
+	s := &routeStore{
+		path:   path,
+		ttl:    ttl,
+		log:    log,
+		routes: map[string]route{},
+	}
+	if path == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.routes); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// get returns the upstream of an ID.
+func (s *routeStore) get(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.routes[id]
+	if !ok || time.Since(r.Time) > s.ttl {
+		return "", false
+	}
+	return r.Upstream, true
+}
+
+// set records the upstream of an ID.
+func (s *routeStore) set(id, upstream string) {
+	s.setAll(map[string]string{id: upstream})
+}
+
+// setAll records the upstreams of IDs and saves the store once. Routes that
+// are seen again are refreshed, so they only expire once they are no longer
+// seen.
+func (s *routeStore) setAll(upstreams map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		now     = time.Now()
+		changed bool
+	)
+	for id, upstream := range upstreams {
+		r, ok := s.routes[id]
+		changed = changed || !ok || r.Upstream != upstream
+		s.routes[id] = route{
+			Upstream: upstream,
+			Time:     now,
+		}
+	}
+	if changed || len(upstreams) != 0 && now.Sub(s.saved) > routeSaveInterval {
+		s.save()
+	}
+}
+
+// delete forgets an ID.
+func (s *routeStore) delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.routes[id]; !ok {
+		return
+	}
+	delete(s.routes, id)
+	s.save()
+}
+
+// retain forgets the routes to upstreams that keep rejects and returns how
+// many it forgot.
+func (s *routeStore) retain(keep func(upstream string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, r := range s.routes {
+		if !keep(r.Upstream) {
+			delete(s.routes, id)
+			n++
+		}
+	}
+	if n > 0 {
+		s.save()
+	}
+	return n
+}
+
+// save drops expired routes and writes the rest to the store file.
+func (s *routeStore) save() {
+	for id, r := range s.routes {
+		if time.Since(r.Time) > s.ttl {
+			delete(s.routes, id)
+		}
+	}
+	s.saved = time.Now()
+	if s.path == "" {
+		return
+	}
+	if err := writeFileAtomic(s.path, s.routes); err != nil {
+		s.log.Error("failed to save routes", "path", s.path, "error", err)
+	}
+}
+
+// writeFileAtomic writes v as json to a file by replacing it.
+func writeFileAtomic(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeRawFileAtomic(path, b)
+}
+
+// writeRawFileAtomic writes b to a file by replacing it.
+func writeRawFileAtomic(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
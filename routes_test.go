@@ -0,0 +1,75 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRouteStoreRefresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	s, err := newRouteStore(path, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := func() string {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	s.set("bug", "a")
+	first := saved()
+	// A route seen again is refreshed but only saved after a while.
+	s.mu.Lock()
+	s.routes["bug"] = route{Upstream: "a", Time: time.Now().Add(-50 * time.Minute)}
+	s.mu.Unlock()
+	s.setAll(map[string]string{"bug": "a"})
+	if saved() != first {
+		t.Errorf("refreshed route saved right away")
+	}
+	s.mu.Lock()
+	s.saved = time.Now().Add(-2 * routeSaveInterval)
+	s.routes["bug"] = route{Upstream: "a", Time: time.Now().Add(-50 * time.Minute)}
+	s.mu.Unlock()
+	s.set("bug", "a")
+	if saved() == first {
+		t.Errorf("refreshed route not saved after %v", routeSaveInterval)
+	}
+	// The route lives on past the TTL of its first sighting.
+	s.mu.Lock()
+	refreshed := s.routes["bug"].Time
+	s.mu.Unlock()
+	if time.Since(refreshed) > time.Minute {
+		t.Errorf("route seen at %v, want now", refreshed)
+	}
+
+	// A route whose upstream changed is saved right away.
+	s.set("bug", "b")
+	restored, err := newRouteStore(path, time.Hour, s.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstream, ok := restored.get("bug"); !ok || upstream != "b" {
+		t.Errorf("got saved route %q, want b", upstream)
+	}
+}
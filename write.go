@@ -0,0 +1,158 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+// Write policies decide when a write mirrored to every upstream succeeds.
+const (
+	// WritePrimary succeeds if the primary upstream accepted the write.
+	WritePrimary = "primary"
+	// WriteAll succeeds if every upstream accepted the write.
+	WriteAll = "all"
+	// WriteQuorum succeeds if at least Quorum upstreams accepted the write.
+	WriteQuorum = "quorum"
+	// WriteBestEffort always succeeds.
+	WriteBestEffort = "best_effort"
+)
+
+// defaultWritePolicy is the key of the policy of methods without one.
+const defaultWritePolicy = "default"
+
+var (
+	errWriteFailed = errors.New("write policy not met")
+)
+
+// WritePolicy is the write policy of an API method.
+type WritePolicy struct {
+	Policy string `yaml:"policy"`
+	Quorum int    `yaml:"quorum"`
+}
+
+func (w WritePolicy) validate(upstreams int) error {
+	switch w.Policy {
+	case WritePrimary:
+		if upstreams == 0 {
+			return fmt.Errorf("primary write policy without upstreams")
+		}
+	case WriteAll, WriteBestEffort:
+	case WriteQuorum:
+		if w.Quorum < 1 || w.Quorum > upstreams {
+			return fmt.Errorf("quorum %d out of range for %d upstreams", w.Quorum, upstreams)
+		}
+	default:
+		return fmt.Errorf("unknown write policy %q", w.Policy)
+	}
+	return nil
+}
+
+// writeOutcome is the outcome of a mirrored write, it is returned to the
+// caller along with the response.
+type writeOutcome struct {
+	Policy   string
+	OK       bool
+	Accepted []string
+	Errors   map[string]string `json:",omitempty"`
+	// Queued are the upstreams the write was queued for while offline.
+	Queued []string `json:",omitempty"`
+}
+
+// writePolicy returns the write policy of a method.
+func (p *proxy) writePolicy(method string) WritePolicy {
+	if w, ok := p.writePolicies[method]; ok {
+		return w
+	}
+	if w, ok := p.writePolicies[defaultWritePolicy]; ok {
+		return w
+	}
+	return WritePolicy{Policy: WriteAll}
+}
+
+// mirror sends a write to every upstream and decides its outcome by the
+// write policy of the method, it returns the results of the upstreams that
+// accepted it, if any.
+func mirror[T any](p *proxy, c *gin.Context, method string, fn func(*dashapi.Dashboard) (T, error)) (map[string]T, *writeOutcome) {
+	var (
+		policy  = p.writePolicy(method)
+		outcome = &writeOutcome{
+			Policy: policy.Policy,
+			Errors: map[string]string{},
+		}
+	)
+	defer p.cache.invalidate(method)
+	resps, errs := gatherErrors(p, c, fn)
+	// Writes are only queued when every upstream failed transiently, the
+	// ones an upstream rejected would fail again.
+	queue := len(resps) == 0
+	for _, addr := range p.order {
+		if _, ok := resps[addr]; ok {
+			outcome.Accepted = append(outcome.Accepted, addr)
+			p.metrics.writeCounters.WithLabelValues(method, addr, "accepted").Inc()
+			continue
+		}
+		outcome.Errors[addr] = errs[addr].Error()
+		queue = queue && transient(errs[addr])
+		p.metrics.writeCounters.WithLabelValues(method, addr, "failed").Inc()
+	}
+	switch {
+	case queue && p.queue(c, func(dash *dashapi.Dashboard) error {
+		_, err := fn(dash)
+		return err
+	}):
+		// Writes queued while offline are accepted, the upstreams will get
+		// them once they are back.
+		outcome.Queued = p.order
+		outcome.OK = true
+	case policy.Policy == WritePrimary:
+		_, outcome.OK = resps[p.order[0]]
+	case policy.Policy == WriteQuorum:
+		outcome.OK = len(outcome.Accepted) >= policy.Quorum
+	case policy.Policy == WriteBestEffort:
+		outcome.OK = true
+	default:
+		outcome.OK = len(outcome.Accepted) == len(p.order)
+	}
+	p.metrics.writeOutcomeCounters.WithLabelValues(method, policy.Policy, fmt.Sprint(outcome.OK)).Inc()
+	if !outcome.OK {
+		p.logger(c).Warn("write failed", "policy", policy.Policy, "accepted", len(outcome.Accepted))
+	}
+	return resps, outcome
+}
+
+// write mirrors a write without a response and responds with its outcome.
+func (p *proxy) write(c *gin.Context, method string, fn func(*dashapi.Dashboard) error) {
+	_, outcome := mirror(p, c, method, func(dash *dashapi.Dashboard) (struct{}, error) {
+		return struct{}{}, fn(dash)
+	})
+	respondWrite(c, outcome, gin.H{})
+}
+
+// respondWrite responds to a write with its outcome added to the response.
+func respondWrite(c *gin.Context, outcome *writeOutcome, resp gin.H) {
+	resp["Write"] = outcome
+	if !outcome.OK {
+		resp["error"] = errWriteFailed.Error()
+		c.JSON(http.StatusBadGateway, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
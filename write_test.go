@@ -0,0 +1,70 @@
+// Copyright © 2020 Daniel Hodges <hodges.daniel.scott@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+)
+
+func TestMirrorPolicies(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		policy  WritePolicy
+		offline bool
+		// statuses are the answers of the primary and the second upstream.
+		statuses [2]int
+		ok       bool
+	}{
+		{"all", WritePolicy{Policy: WriteAll}, false, [2]int{http.StatusOK, http.StatusOK}, true},
+		{"all with a failure", WritePolicy{Policy: WriteAll}, false, [2]int{http.StatusOK, http.StatusInternalServerError}, false},
+		{"primary", WritePolicy{Policy: WritePrimary}, false, [2]int{http.StatusOK, http.StatusInternalServerError}, true},
+		{"primary failed", WritePolicy{Policy: WritePrimary}, false, [2]int{http.StatusInternalServerError, http.StatusOK}, false},
+		{"quorum", WritePolicy{Policy: WriteQuorum, Quorum: 1}, false, [2]int{http.StatusInternalServerError, http.StatusOK}, true},
+		{"quorum missed", WritePolicy{Policy: WriteQuorum, Quorum: 2}, false, [2]int{http.StatusInternalServerError, http.StatusOK}, false},
+		{"best effort", WritePolicy{Policy: WriteBestEffort}, false, [2]int{http.StatusInternalServerError, http.StatusInternalServerError}, true},
+		{"queued while offline", WritePolicy{Policy: WriteAll}, true, [2]int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, true},
+		{"rejected while offline", WritePolicy{Policy: WriteAll}, true, [2]int{http.StatusServiceUnavailable, http.StatusBadRequest}, false},
+		{"rejected by every upstream", WritePolicy{Policy: WriteAll}, true, [2]int{http.StatusBadRequest, http.StatusBadRequest}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			upstreams := []*fakeDashboard{newFakeDashboard(t), newFakeDashboard(t)}
+			for i, u := range upstreams {
+				u.setStatus(test.statuses[i])
+			}
+			p, client := newTestProxy(t, &Config{
+				WritePolicies: map[string]WritePolicy{"upload_build": test.policy},
+				Offline:       OfflineConfig{Enabled: test.offline},
+			}, upstreams...)
+
+			err := client.UploadBuild(&dashapi.Build{Manager: "m", ID: "b"})
+			if ok := err == nil; ok != test.ok {
+				t.Errorf("got error %v, want ok %v", err, test.ok)
+			}
+			p.offline.mu.Lock()
+			queued := len(p.offline.queue)
+			p.offline.mu.Unlock()
+			want := 0
+			if test.offline && test.ok {
+				want = len(upstreams)
+			}
+			if queued != want {
+				t.Errorf("got %v queued writes, want %v", queued, want)
+			}
+		})
+	}
+}